@@ -1,10 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
-	"reflect"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -12,77 +15,203 @@ import (
 
 // go test -v homework_test.go
 
-type MultiError struct {
-	errs []error
-}
+// ErrorFormatFunc renders the accumulated errors into the MultiError message.
+type ErrorFormatFunc func(errs []error) string
 
-func (e *MultiError) Error() string {
-	if len(e.errs) == 0 {
+// ListFormat is the default format: a header followed by one error per line.
+func ListFormat(errs []error) string {
+	if len(errs) == 0 {
 		return ""
 	}
 
 	var sb strings.Builder
-	sb.WriteString(strconv.Itoa(len(e.errs)))
-	sb.WriteString(" errors occurred:\n")
-	for _, err := range e.errs {
+	sb.WriteString(strconv.Itoa(len(errs)))
+	if len(errs) == 1 {
+		sb.WriteString(" error occurred:\n")
+	} else {
+		sb.WriteString(" errors occurred:\n")
+	}
+	for _, err := range errs {
 		sb.WriteString("\t* ")
 		sb.WriteString(err.Error())
+		sb.WriteString("\n")
 	}
-	sb.WriteString("\n")
 	return sb.String()
 }
 
+// LineFormat joins the errors into a single line separated by "; ".
+func LineFormat(errs []error) string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// JSONFormat renders the errors as a JSON array of messages.
+func JSONFormat(errs []error) string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	out, _ := json.Marshal(msgs) // marshaling of []string never fails.
+	return string(out)
+}
+
+type MultiError struct {
+	errs []error
+
+	// ErrorFormat overrides the message format, ListFormat is used if nil.
+	ErrorFormat ErrorFormatFunc
+}
+
+func (e *MultiError) Error() string {
+	if e == nil || len(e.errs) == 0 {
+		return ""
+	}
+
+	format := e.ErrorFormat
+	if format == nil {
+		format = ListFormat
+	}
+	return format(e.errs)
+}
+
+// ErrorOrNil returns nil if no errors were accumulated, the MultiError
+// itself otherwise. Use it when returning the result as a plain error,
+// so callers don't get a non-nil error interface holding an empty value.
+func (e *MultiError) ErrorOrNil() error {
+	if e == nil || len(e.errs) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Append adds errs to err. Nil errors are skipped and nested MultiErrors
+// are flattened, so the result is always one level deep.
+// If err is a MultiError it is extended in place: Append is not safe for
+// concurrent use, see Collector for that.
 func Append(err error, errs ...error) (m *MultiError) {
+	var ok bool
+	if m, ok = err.(*MultiError); !ok || m == nil {
+		m = &MultiError{errs: make([]error, 0, len(errs)+1)}
+		m.errs = flatten(m.errs, err)
+	}
+
+	for _, e := range errs {
+		m.errs = flatten(m.errs, e)
+	}
+	return
+}
+
+func flatten(dst []error, err error) []error {
 	if err == nil {
-		m = &MultiError{errs: errs}
-		return
+		return dst
 	}
 
-	var ok bool
-	m, ok = err.(*MultiError)
-	if ok {
-		m.errs = append(m.errs, errs...)
+	m, ok := err.(*MultiError)
+	if !ok {
+		return append(dst, err)
+	}
+	if m == nil {
+		return dst
+	}
+	for _, e := range m.errs {
+		dst = flatten(dst, e)
+	}
+	return dst
+}
+
+// Collector accumulates errors from several goroutines.
+// The zero value is ready to use.
+type Collector struct {
+	wg sync.WaitGroup
+
+	mu   sync.Mutex
+	errs []error
+}
+
+// Add records err, nil errors are ignored. Safe for concurrent use.
+func (c *Collector) Add(err error) {
+	if err == nil {
 		return
 	}
 
-	m = &MultiError{errs: make([]error, 0, len(errs))}
-	m.errs = append(m.errs, err)
-	m.errs = append(m.errs, errs...)
-	return
+	c.mu.Lock()
+	c.errs = flatten(c.errs, err)
+	c.mu.Unlock()
+}
+
+// Go runs fn in a new goroutine and records its error.
+func (c *Collector) Go(fn func() error) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.Add(fn())
+	}()
 }
 
+// Wait blocks until all goroutines started with Go are done and returns
+// the collected errors, or nil if there are none.
+// Errors are kept in the order they were added, which for goroutines is
+// the order they finished in.
+func (c *Collector) Wait() error {
+	c.wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.errs) == 0 {
+		return nil
+	}
+	errs := make([]error, len(c.errs))
+	copy(errs, c.errs)
+	return &MultiError{errs: errs}
+}
+
+// Unwrap returns the accumulated errors, so errors.Is and errors.As
+// walk every one of them (see the errors package docs since go 1.20).
+func (e *MultiError) Unwrap() []error {
+	if e == nil {
+		return nil
+	}
+	return e.errs
+}
+
+// Is reports whether any of the accumulated errors matches target,
+// following the wrapping chain of each of them.
 func (e *MultiError) Is(target error) bool {
+	if e == nil {
+		return false
+	}
 	for _, err := range e.errs {
-		if err == target {
+		if errors.Is(err, target) {
 			return true
 		}
 	}
 	return false
 }
 
+// As finds the first accumulated error that matches target and sets
+// target to it. Interface targets and wrapped errors are supported.
 func (e *MultiError) As(target any) bool {
+	if e == nil {
+		return false
+	}
 	for _, err := range e.errs {
-		if reflect.TypeOf(err) == reflect.TypeOf(target).Elem() {
-			reflect.ValueOf(target).Elem().Set(reflect.ValueOf(err))
+		if errors.As(err, target) {
 			return true
 		}
 	}
 	return false
 }
 
-func (e *MultiError) Unwrap() error {
-	if len(e.errs) <= 1 {
-		return nil
-	}
-	return &MultiError{errs: e.errs[:len(e.errs)-1]}
-}
-
 func TestMultiError(t *testing.T) {
 	var err error
 	err = Append(err, errors.New("error 1"))
 	err = Append(err, errors.New("error 2"))
 
-	expectedMessage := "2 errors occurred:\n\t* error 1\t* error 2\n"
+	expectedMessage := "2 errors occurred:\n\t* error 1\n\t* error 2\n"
 	assert.EqualError(t, err, expectedMessage)
 }
 
@@ -91,7 +220,7 @@ func TestMultiError_DifferentBaseError(t *testing.T) {
 	err := Append(baseErr, errors.New("error 1"))
 	err = Append(err, errors.New("error 2"))
 
-	expectedMessage := "3 errors occurred:\n\t* test\t* error 1\t* error 2\n"
+	expectedMessage := "3 errors occurred:\n\t* test\n\t* error 1\n\t* error 2\n"
 	assert.EqualError(t, err, expectedMessage)
 }
 
@@ -129,18 +258,140 @@ func TestMultiError_As(t *testing.T) {
 	assert.True(t, te.msg == "error 2")
 }
 
-func TestMultiError_Unwrap(t *testing.T) {
+func TestMultiError_IsWrapped(t *testing.T) {
+	err1 := errors.New("error 1")
+	err2 := errors.New("error 2")
+
+	var err error
+	err = Append(err, fmt.Errorf("wrapped: %w", err1))
+	err = Append(err, errors.New("error 3"))
+	err = fmt.Errorf("outer: %w", err)
+
+	assert.True(t, errors.Is(err, err1))
+	assert.False(t, errors.Is(err, err2))
+}
+
+type temporary interface {
+	Temporary() bool
+}
+
+type temporaryError struct{}
+
+func (e temporaryError) Error() string   { return "temporary" }
+func (e temporaryError) Temporary() bool { return true }
+
+func TestMultiError_AsInterface(t *testing.T) {
 	var err error
 	err = Append(err, errors.New("error 1"))
-	err = Append(err, errors.New("error 2"))
+	err = Append(err, fmt.Errorf("wrapped: %w", temporaryError{}))
 
-	exp := "2 errors occurred:\n\t* error 1\t* error 2\n"
-	assert.EqualError(t, err, exp)
+	var tmp temporary
+	assert.True(t, errors.As(err, &tmp))
+	assert.True(t, tmp.Temporary())
+
+	var te *testError
+	assert.False(t, errors.As(err, &te))
+}
+
+func TestMultiError_AsNested(t *testing.T) {
+	inner := Append(nil, errors.New("error 1"), &testError{msg: "deep"})
+	err := Append(nil, errors.New("error 2"), fmt.Errorf("wrapped: %w", inner))
+
+	var te *testError
+	assert.True(t, errors.As(err, &te))
+	assert.Equal(t, "deep", te.msg)
+}
+
+func TestMultiError_Unwrap(t *testing.T) {
+	err1 := errors.New("error 1")
+	err2 := errors.New("error 2")
 
-	err = errors.Unwrap(err)
-	exp = "1 errors occurred:\n\t* error 1\n"
+	var err error
+	err = Append(err, err1)
+	err = Append(err, err2)
+
+	exp := "2 errors occurred:\n\t* error 1\n\t* error 2\n"
 	assert.EqualError(t, err, exp)
 
-	err = errors.Unwrap(err)
-	assert.Nil(t, err)
+	// errors.Unwrap only follows Unwrap() error.
+	assert.Nil(t, errors.Unwrap(err))
+
+	u, ok := err.(interface{ Unwrap() []error })
+	assert.True(t, ok)
+	assert.Equal(t, []error{err1, err2}, u.Unwrap())
+
+	var m *MultiError
+	assert.Nil(t, m.Unwrap())
+	assert.False(t, m.Is(err1))
+}
+
+func TestMultiError_Format(t *testing.T) {
+	err := Append(nil, errors.New("error 1"), errors.New("error 2"))
+
+	err.ErrorFormat = LineFormat
+	assert.EqualError(t, err, "error 1; error 2")
+
+	err.ErrorFormat = JSONFormat
+	assert.EqualError(t, err, `["error 1","error 2"]`)
+
+	err.ErrorFormat = nil
+	assert.EqualError(t, Append(nil, errors.New("error 1")), "1 error occurred:\n\t* error 1\n")
+}
+
+func TestMultiError_Flatten(t *testing.T) {
+	err1 := errors.New("error 1")
+	err2 := errors.New("error 2")
+	err3 := errors.New("error 3")
+
+	inner := Append(nil, err1, nil, err2)
+	err := Append(inner, Append(nil, Append(nil, err3)))
+	assert.Equal(t, []error{err1, err2, err3}, err.Unwrap())
+
+	err = Append(errors.New("error 0"), Append(nil, err1, err2))
+	assert.Len(t, err.Unwrap(), 3)
+
+	wrapped := fmt.Errorf("ctx: %w", inner)
+	err = Append(nil, wrapped)
+	assert.Equal(t, []error{wrapped}, err.Unwrap())
+}
+
+func TestMultiError_ErrorOrNil(t *testing.T) {
+	var m *MultiError
+	assert.Nil(t, m.ErrorOrNil())
+	assert.Nil(t, Append(nil).ErrorOrNil())
+	assert.Nil(t, Append(nil, nil, nil).ErrorOrNil())
+
+	err := Append(nil, errors.New("error 1"))
+	assert.Equal(t, err, err.ErrorOrNil())
+}
+
+func TestCollector(t *testing.T) {
+	var c Collector
+	assert.NoError(t, c.Wait())
+
+	const workers = 100
+	for i := 0; i < workers; i++ {
+		c.Go(func() error {
+			if i%2 == 0 {
+				return nil
+			}
+			return fmt.Errorf("error %d", i)
+		})
+	}
+	c.Add(Append(nil, errors.New("a"), errors.New("b")))
+
+	err := c.Wait()
+	assert.Error(t, err)
+
+	var m *MultiError
+	assert.True(t, errors.As(err, &m))
+
+	msgs := make([]string, 0, len(m.Unwrap()))
+	for _, e := range m.Unwrap() {
+		msgs = append(msgs, e.Error())
+	}
+	sort.Strings(msgs)
+	assert.Len(t, msgs, workers/2+2)
+	assert.Equal(t, "a", msgs[0])
+	assert.Equal(t, "b", msgs[1])
 }
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v homework_test.go optional_test.go
+
+var ErrNoValue = errors.New("option has no value")
+
+// Option holds either a value or nothing. The zero value is None.
+type Option[T any] struct {
+	value   T
+	present bool
+}
+
+func Some[T any](value T) Option[T] {
+	return Option[T]{value: value, present: true}
+}
+
+func None[T any]() Option[T] {
+	return Option[T]{}
+}
+
+// OptionOf converts the comma-ok idiom into an Option.
+func OptionOf[T any](value T, ok bool) Option[T] {
+	if !ok {
+		return None[T]()
+	}
+	return Some(value)
+}
+
+// OptionFromPtr returns None for a nil pointer and Some(*ptr) otherwise.
+func OptionFromPtr[T any](ptr *T) Option[T] {
+	if ptr == nil {
+		return None[T]()
+	}
+	return Some(*ptr)
+}
+
+func (o Option[T]) IsSome() bool { return o.present }
+func (o Option[T]) IsNone() bool { return !o.present }
+
+// Get returns the value in the comma-ok form.
+func (o Option[T]) Get() (T, bool) {
+	return o.value, o.present
+}
+
+// Unwrap returns the value and panics if there is none.
+func (o Option[T]) Unwrap() T {
+	if !o.present {
+		panic(ErrNoValue)
+	}
+	return o.value
+}
+
+// OrElse returns the value or fallback if there is none.
+func (o Option[T]) OrElse(fallback T) T {
+	if !o.present {
+		return fallback
+	}
+	return o.value
+}
+
+// OrElseGet is OrElse with a lazily computed fallback.
+func (o Option[T]) OrElseGet(fallback func() T) T {
+	if !o.present {
+		return fallback()
+	}
+	return o.value
+}
+
+// Result converts the Option into a Result, None becomes err.
+func (o Option[T]) Result(err error) Result[T] {
+	if !o.present {
+		return Err[T](err)
+	}
+	return Ok(o.value)
+}
+
+func (o Option[T]) String() string {
+	if !o.present {
+		return "None"
+	}
+	return fmt.Sprintf("Some(%v)", o.value)
+}
+
+// MarshalJSON encodes None as null and Some as the value itself.
+func (o Option[T]) MarshalJSON() ([]byte, error) {
+	if !o.present {
+		return []byte("null"), nil
+	}
+	return json.Marshal(o.value)
+}
+
+// UnmarshalJSON decodes null as None and anything else as Some.
+func (o *Option[T]) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*o = None[T]()
+		return nil
+	}
+
+	var value T
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*o = Some(value)
+	return nil
+}
+
+// Methods can't have type parameters, so transformations that change the
+// type are functions.
+
+func MapOption[T, U any](o Option[T], fn func(T) U) Option[U] {
+	if !o.present {
+		return None[U]()
+	}
+	return Some(fn(o.value))
+}
+
+func FlatMapOption[T, U any](o Option[T], fn func(T) Option[U]) Option[U] {
+	if !o.present {
+		return None[U]()
+	}
+	return fn(o.value)
+}
+
+// Result holds either a value or an error.
+// The zero value is Ok with the zero value of T.
+type Result[T any] struct {
+	value T
+	err   error
+}
+
+func Ok[T any](value T) Result[T] {
+	return Result[T]{value: value}
+}
+
+// Err makes a failed Result. A nil err is replaced by ErrNoValue, so a
+// failed Result always carries an error.
+func Err[T any](err error) Result[T] {
+	if err == nil {
+		err = ErrNoValue
+	}
+	return Result[T]{err: err}
+}
+
+// ResultOf converts the (value, error) idiom into a Result.
+func ResultOf[T any](value T, err error) Result[T] {
+	if err != nil {
+		return Err[T](err)
+	}
+	return Ok(value)
+}
+
+func (r Result[T]) IsOk() bool  { return r.err == nil }
+func (r Result[T]) IsErr() bool { return r.err != nil }
+func (r Result[T]) Err() error  { return r.err }
+
+// Get returns the result in the (value, error) form.
+func (r Result[T]) Get() (T, error) {
+	return r.value, r.err
+}
+
+// Unwrap returns the value and panics with the error if there is one.
+func (r Result[T]) Unwrap() T {
+	if r.err != nil {
+		panic(r.err)
+	}
+	return r.value
+}
+
+// OrElse returns the value or fallback if the Result failed.
+func (r Result[T]) OrElse(fallback T) T {
+	if r.err != nil {
+		return fallback
+	}
+	return r.value
+}
+
+// OrElseGet is OrElse with a fallback computed from the error.
+func (r Result[T]) OrElseGet(fallback func(error) T) T {
+	if r.err != nil {
+		return fallback(r.err)
+	}
+	return r.value
+}
+
+// Option drops the error: a failed Result becomes None.
+func (r Result[T]) Option() Option[T] {
+	if r.err != nil {
+		return None[T]()
+	}
+	return Some(r.value)
+}
+
+func (r Result[T]) String() string {
+	if r.err != nil {
+		return fmt.Sprintf("Err(%v)", r.err)
+	}
+	return fmt.Sprintf("Ok(%v)", r.value)
+}
+
+func MapResult[T, U any](r Result[T], fn func(T) U) Result[U] {
+	if r.err != nil {
+		return Err[U](r.err)
+	}
+	return Ok(fn(r.value))
+}
+
+func FlatMapResult[T, U any](r Result[T], fn func(T) Result[U]) Result[U] {
+	if r.err != nil {
+		return Err[U](r.err)
+	}
+	return fn(r.value)
+}
+
+// Collect turns the results into a single Result with all the values,
+// or the first error.
+func Collect[T any](results []Result[T]) Result[[]T] {
+	values := make([]T, 0, len(results))
+	for _, r := range results {
+		if r.err != nil {
+			return Err[[]T](r.err)
+		}
+		values = append(values, r.value)
+	}
+	return Ok(values)
+}
+
+// CollectAll is Collect that doesn't stop at the first error: every
+// error is accumulated into a MultiError.
+func CollectAll[T any](results []Result[T]) Result[[]T] {
+	var merr *MultiError
+	values := make([]T, 0, len(results))
+	for _, r := range results {
+		if r.err != nil {
+			merr = Append(merr, r.err)
+			continue
+		}
+		values = append(values, r.value)
+	}
+
+	if err := merr.ErrorOrNil(); err != nil {
+		return Err[[]T](err)
+	}
+	return Ok(values)
+}
+
+func divide(lhs, rhs int) Option[int] {
+	if rhs == 0 {
+		return None[int]()
+	}
+	return Some(lhs / rhs)
+}
+
+func TestOption(t *testing.T) {
+	opt := divide(100, 0)
+	assert.True(t, opt.IsNone())
+	assert.Equal(t, -1, opt.OrElse(-1))
+	assert.Equal(t, 7, opt.OrElseGet(func() int { return 7 }))
+	assert.PanicsWithValue(t, ErrNoValue, func() { opt.Unwrap() })
+	assert.Equal(t, "None", opt.String())
+
+	opt = divide(100, 5)
+	assert.True(t, opt.IsSome())
+	assert.Equal(t, 20, opt.Unwrap())
+	assert.Equal(t, 20, opt.OrElse(-1))
+	assert.Equal(t, "Some(20)", opt.String())
+
+	var zero Option[string]
+	assert.True(t, zero.IsNone())
+}
+
+func TestOption_Conversions(t *testing.T) {
+	m := map[string]int{"one": 1}
+
+	value, ok := m["one"]
+	v, ok := OptionOf(value, ok).Get()
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	value, ok = m["two"]
+	assert.True(t, OptionOf(value, ok).IsNone())
+
+	assert.True(t, OptionFromPtr[int](nil).IsNone())
+	assert.Equal(t, Some(3), OptionFromPtr(ptr(3)))
+
+	_, err := None[int]().Result(ErrNoValue).Get()
+	assert.ErrorIs(t, err, ErrNoValue)
+	assert.Equal(t, Ok(5), Some(5).Result(ErrNoValue))
+}
+
+func TestOption_MapFlatMap(t *testing.T) {
+	itoa := func(v int) string { return strconv.Itoa(v) }
+	assert.Equal(t, Some("20"), MapOption(divide(100, 5), itoa))
+	assert.Equal(t, None[string](), MapOption(divide(100, 0), itoa))
+
+	half := func(v int) Option[int] { return divide(v, 2) }
+	assert.Equal(t, Some(10), FlatMapOption(divide(100, 5), half))
+	assert.Equal(t, None[int](), FlatMapOption(divide(100, 0), half))
+}
+
+func TestOption_JSON(t *testing.T) {
+	type user struct {
+		Name string         `json:"name"`
+		Age  Option[int]    `json:"age"`
+		Nick Option[string] `json:"nick"`
+	}
+
+	out, err := json.Marshal(user{Name: "John", Age: Some(0)})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"name":"John","age":0,"nick":null}`, string(out))
+
+	var u user
+	assert.NoError(t, json.Unmarshal([]byte(`{"name":"Jane","age":null,"nick":"jj"}`), &u))
+	assert.Equal(t, user{Name: "Jane", Nick: Some("jj")}, u)
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"name":"Jane"}`), &u))
+	assert.Equal(t, Some("jj"), u.Nick) // absent keys are left untouched, like in encoding/json.
+
+	assert.Error(t, json.Unmarshal([]byte(`{"age":"ten"}`), &u))
+}
+
+func TestResult(t *testing.T) {
+	r := ResultOf(strconv.Atoi("42"))
+	assert.True(t, r.IsOk())
+	assert.Equal(t, 42, r.Unwrap())
+	assert.Equal(t, "Ok(42)", r.String())
+	assert.Equal(t, Some(42), r.Option())
+
+	r = ResultOf(strconv.Atoi("forty two"))
+	assert.True(t, r.IsErr())
+	assert.ErrorIs(t, r.Err(), strconv.ErrSyntax)
+	assert.Equal(t, 0, r.OrElse(0))
+	assert.Equal(t, -1, r.OrElseGet(func(error) int { return -1 }))
+	assert.Panics(t, func() { r.Unwrap() })
+	assert.True(t, r.Option().IsNone())
+
+	v, err := r.Get()
+	assert.Error(t, err)
+	assert.Equal(t, 0, v)
+
+	assert.ErrorIs(t, Err[int](nil).Err(), ErrNoValue)
+}
+
+func TestResult_MapFlatMap(t *testing.T) {
+	parse := func(s string) Result[int] { return ResultOf(strconv.Atoi(s)) }
+	double := func(v int) int { return v * 2 }
+
+	assert.Equal(t, Ok(84), MapResult(parse("42"), double))
+	assert.True(t, MapResult(parse("x"), double).IsErr())
+
+	r := FlatMapResult(Ok("21"), parse)
+	assert.Equal(t, Ok(21), r)
+
+	r = FlatMapResult(Err[string](ErrNoValue), parse)
+	assert.ErrorIs(t, r.Err(), ErrNoValue)
+}
+
+func TestCollect(t *testing.T) {
+	parse := func(s string) Result[int] { return ResultOf(strconv.Atoi(s)) }
+
+	r := Collect([]Result[int]{parse("1"), parse("2"), parse("3")})
+	assert.Equal(t, []int{1, 2, 3}, r.Unwrap())
+
+	r = Collect([]Result[int]{parse("1"), parse("x"), parse("y")})
+	assert.EqualError(t, r.Err(), `strconv.Atoi: parsing "x": invalid syntax`)
+
+	r = CollectAll([]Result[int]{parse("1"), parse("x"), parse("y")})
+	var merr *MultiError
+	assert.True(t, errors.As(r.Err(), &merr))
+	assert.Len(t, merr.Unwrap(), 2)
+	assert.ErrorIs(t, r.Err(), strconv.ErrSyntax)
+
+	assert.Equal(t, []int{}, Collect[int](nil).Unwrap())
+	assert.Equal(t, []int{}, CollectAll[int](nil).Unwrap())
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v homework_test.go structured_test.go recover_test.go
+
+// PanicError is a recovered panic turned into an error.
+type PanicError struct {
+	Value any
+	Stack Stack // stack of the panicking goroutine at the point of recovery.
+}
+
+func newPanicError(v any, skip int) *PanicError {
+	return &PanicError{Value: v, Stack: callers(skip + 1)}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Unwrap returns the panic value if it is an error, so errors.Is and
+// errors.As see through panic(err).
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+func (e *PanicError) Format(st fmt.State, verb rune) {
+	switch verb {
+	case 'v':
+		if st.Flag('+') {
+			io.WriteString(st, e.Error())
+			e.Stack.Format(st, verb)
+			return
+		}
+		fallthrough
+	case 's':
+		io.WriteString(st, e.Error())
+	case 'q':
+		fmt.Fprintf(st, "%q", e.Error())
+	}
+}
+
+// PanicHandler receives recovered panics. A nil handler logs the panic
+// with its stack trace.
+type PanicHandler func(err *PanicError)
+
+func handlePanic(handler PanicHandler, err *PanicError) {
+	if handler == nil {
+		log.Printf("%+v", err)
+		return
+	}
+	handler(err)
+}
+
+// Recover stores a recovered panic in *errp as a *PanicError.
+// It must be deferred directly: defer Recover(&err).
+func Recover(errp *error) {
+	if v := recover(); v != nil {
+		*errp = newPanicError(v, 1)
+	}
+}
+
+// Catch calls fn and converts its panic, if any, into an error.
+func Catch(fn func() error) (err error) {
+	defer Recover(&err)
+	return fn()
+}
+
+// SafeGo runs fn in a new goroutine. A panic in fn is passed to handler
+// instead of crashing the process.
+func SafeGo(fn func(), handler PanicHandler) {
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				handlePanic(handler, newPanicError(v, 1))
+			}
+		}()
+		fn()
+	}()
+}
+
+const maxAcceptDelay = time.Second
+
+// ServeConns accepts connections from l and serves each one with handle
+// in its own goroutine. A panic in handle closes that connection and is
+// passed to handler, the other connections keep being served.
+// A temporary Accept error, such as too many open files, is retried with
+// a back-off as net/http does. ServeConns returns nil once l is closed, or
+// the first other Accept error.
+func ServeConns(l net.Listener, handle func(net.Conn), handler PanicHandler) error {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				delay = min(max(2*delay, 5*time.Millisecond), maxAcceptDelay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		SafeGo(func() {
+			defer conn.Close()
+			handle(conn)
+		}, handler)
+	}
+}
+
+// RecoverMiddleware recovers panics in next, passes them to handler and
+// replies with 500 Internal Server Error. If next has already written the
+// headers the reply can't be changed, so the response is aborted with
+// http.ErrAbortHandler instead. http.ErrAbortHandler panicked by next is
+// re-panicked, since net/http uses it to abort a response on purpose.
+func RecoverMiddleware(next http.Handler, handler PanicHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			handlePanic(handler, newPanicError(v, 1))
+			if rw.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// responseWriter records whether the headers were written.
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) Flush() {
+	w.wroteHeader = true
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the other methods of the
+// original writer.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestCatch(t *testing.T) {
+	errInternal := errors.New("internal error")
+
+	err := Catch(func() error { panic(errInternal) })
+	assert.EqualError(t, err, "panic: internal error")
+	assert.True(t, errors.Is(err, errInternal))
+
+	var perr *PanicError
+	assert.True(t, errors.As(err, &perr))
+	assert.Contains(t, fmt.Sprintf("%+v", perr), "TestCatch")
+
+	err = Catch(func() error { panic("boom") })
+	assert.EqualError(t, err, "panic: boom")
+	assert.Nil(t, errors.Unwrap(err))
+
+	assert.NoError(t, Catch(func() error { return nil }))
+	assert.Equal(t, errInternal, Catch(func() error { return errInternal }))
+}
+
+func TestSafeGo(t *testing.T) {
+	panics := make(chan *PanicError, 1)
+	SafeGo(func() {
+		var m map[string]int
+		m["key"] = 1
+	}, func(err *PanicError) {
+		panics <- err
+	})
+
+	select {
+	case err := <-panics:
+		assert.Contains(t, err.Error(), "assignment to entry in nil map")
+		assert.Contains(t, fmt.Sprintf("%+v", err), "TestSafeGo")
+	case <-time.After(time.Second):
+		t.Fatal("panic was not handled")
+	}
+}
+
+func TestServeConns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	panics := make(chan *PanicError, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeConns(l, func(c net.Conn) {
+			line, err := bufio.NewReader(c).ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.TrimSpace(line) == "panic" {
+				panic(errors.New("internal error"))
+			}
+			io.WriteString(c, "echo: "+line)
+		}, func(err *PanicError) {
+			panics <- err
+		})
+	}()
+
+	send := func(msg string) string {
+		c, err := net.Dial("tcp", l.Addr().String())
+		assert.NoError(t, err)
+		defer c.Close()
+
+		io.WriteString(c, msg+"\n")
+		resp, _ := io.ReadAll(c)
+		return string(resp)
+	}
+
+	assert.Equal(t, "", send("panic"))
+	// the connection is closed before the handler is called.
+	select {
+	case err := <-panics:
+		assert.EqualError(t, err, "panic: internal error")
+	case <-time.After(time.Second):
+		t.Fatal("panic was not handled")
+	}
+	assert.Equal(t, "echo: hello\n", send("hello"))
+
+	assert.NoError(t, l.Close())
+	assert.NoError(t, <-served)
+	assert.Empty(t, panics)
+}
+
+// flakyListener fails Accept with the errors before accepting from the
+// embedded listener.
+type flakyListener struct {
+	net.Listener
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		l.mu.Unlock()
+		return nil, err
+	}
+	l.mu.Unlock()
+	return l.Listener.Accept()
+}
+
+// acceptError is a temporary net.Error like EMFILE.
+type acceptError struct{}
+
+func (acceptError) Error() string   { return "accept: too many open files" }
+func (acceptError) Timeout() bool   { return false }
+func (acceptError) Temporary() bool { return true }
+
+func TestServeConns_AcceptErrors(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	l := &flakyListener{Listener: inner, errs: []error{acceptError{}, acceptError{}}}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeConns(l, func(c net.Conn) {
+			io.WriteString(c, "hello")
+		}, nil)
+	}()
+
+	c, err := net.Dial("tcp", inner.Addr().String())
+	assert.NoError(t, err)
+	resp, _ := io.ReadAll(c)
+	c.Close()
+	assert.Equal(t, "hello", string(resp), "temporary errors are retried")
+
+	errFatal := errors.New("fatal")
+	l.mu.Lock()
+	l.errs = append(l.errs, errFatal)
+	l.mu.Unlock()
+
+	c, err = net.Dial("tcp", inner.Addr().String()) // wakes Accept up.
+	assert.NoError(t, err)
+	c.Close()
+
+	select {
+	case err := <-served:
+		assert.ErrorIs(t, err, errFatal)
+	case <-time.After(time.Second):
+		t.Fatal("ServeConns did not return")
+	}
+	inner.Close()
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	panics := make(chan *PanicError, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	mux.HandleFunc("/partial", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		http.NewResponseController(w).Flush()
+		panic("late boom")
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+
+	srv := httptest.NewServer(RecoverMiddleware(mux, func(err *PanicError) {
+		panics <- err
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/panic")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.EqualError(t, <-panics, "panic: boom")
+
+	// the headers are out, so the response is aborted.
+	resp, err = http.Get(srv.URL + "/partial")
+	assert.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Error(t, err)
+	assert.EqualError(t, <-panics, "panic: late boom")
+
+	resp, err = http.Get(srv.URL + "/ok")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok", string(body))
+}
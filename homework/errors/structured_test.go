@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v homework_test.go structured_test.go
+
+// Code is a machine-readable error class. Code implements error, so it can
+// be used as an errors.Is target: errors.Is(err, CodeNotFound).
+type Code uint32
+
+const (
+	CodeUnknown Code = iota
+	CodeInvalidArgument
+	CodeNotFound
+	CodeAlreadyExists
+	CodePermissionDenied
+	CodeUnavailable
+	CodeTimeout
+	CodeInternal
+)
+
+var codeNames = [...]string{
+	CodeUnknown:          "unknown",
+	CodeInvalidArgument:  "invalid_argument",
+	CodeNotFound:         "not_found",
+	CodeAlreadyExists:    "already_exists",
+	CodePermissionDenied: "permission_denied",
+	CodeUnavailable:      "unavailable",
+	CodeTimeout:          "timeout",
+	CodeInternal:         "internal",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return "code(" + strconv.Itoa(int(c)) + ")"
+}
+
+func (c Code) Error() string {
+	return c.String()
+}
+
+// Field is a key/value pair attached to an error as context.
+type Field struct {
+	Key   string
+	Value any
+}
+
+// Stack is a call stack captured when an error was created.
+type Stack []uintptr
+
+const maxStackDepth = 32
+
+func callers(skip int) Stack {
+	var pcs [maxStackDepth]uintptr
+	n := runtime.Callers(skip+2, pcs[:]) // skip runtime.Callers and callers itself.
+	return pcs[:n]
+}
+
+// Frames resolves the program counters into frames.
+func (s Stack) Frames() []runtime.Frame {
+	if len(s) == 0 {
+		return nil
+	}
+
+	frames := make([]runtime.Frame, 0, len(s))
+	iter := runtime.CallersFrames(s)
+	for {
+		frame, more := iter.Next()
+		frames = append(frames, frame)
+		if !more {
+			break
+		}
+	}
+	return frames
+}
+
+func (s Stack) Format(st fmt.State, verb rune) {
+	for _, f := range s.Frames() {
+		fmt.Fprintf(st, "\n%s\n\t%s:%d", f.Function, f.File, f.Line)
+	}
+}
+
+// Error is a structured error with a code, a message, context fields,
+// an optional cause and the stack of the place where it was created.
+// Error is immutable: With returns a copy.
+type Error struct {
+	code   Code
+	msg    string
+	fields []Field
+	cause  error
+	stack  Stack
+}
+
+// New creates an error with the given code and message.
+func New(code Code, msg string) *Error {
+	return &Error{code: code, msg: msg, stack: callers(1)}
+}
+
+// Newf is New with a formatted message.
+func Newf(code Code, format string, args ...any) *Error {
+	return &Error{code: code, msg: fmt.Sprintf(format, args...), stack: callers(1)}
+}
+
+// Wrap annotates err with a code and a message, it returns nil if err is
+// nil. The result is an error and not an *Error, so that it can be
+// returned as is: use the With func to add the fields.
+func Wrap(err error, code Code, msg string) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{code: code, msg: msg, cause: err, stack: callers(1)}
+}
+
+// Wrapf is Wrap with a formatted message.
+func Wrapf(err error, code Code, format string, args ...any) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{code: code, msg: fmt.Sprintf(format, args...), cause: err, stack: callers(1)}
+}
+
+// With adds the fields to err, see (*Error).With: With(Wrap(err, code,
+// msg), "id", id). An error other than *Error is wrapped with its code
+// first. With of nil is nil.
+func With(err error, kv ...any) error {
+	if err == nil {
+		return nil
+	}
+
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{code: CodeOf(err), cause: err, stack: callers(1)}
+	}
+	return e.With(kv...)
+}
+
+// With returns a copy of the error with additional key/value fields.
+// kv is a list of alternating keys and values, a key without a value
+// gets nil.
+func (e *Error) With(kv ...any) *Error {
+
+	cp := *e
+	cp.fields = make([]Field, len(e.fields), len(e.fields)+(len(kv)+1)/2)
+	copy(cp.fields, e.fields)
+	for i := 0; i < len(kv); i += 2 {
+		f := Field{Key: fmt.Sprint(kv[i])}
+		if i+1 < len(kv) {
+			f.Value = kv[i+1]
+		}
+		cp.fields = append(cp.fields, f)
+	}
+	return &cp
+}
+
+func (e *Error) Code() Code      { return e.code }
+func (e *Error) Message() string { return e.msg }
+func (e *Error) Fields() []Field { return e.fields }
+func (e *Error) Stack() Stack    { return e.stack }
+func (e *Error) Unwrap() error   { return e.cause }
+
+func (e *Error) Error() string {
+	msg := e.msg
+	if msg == "" {
+		msg = e.code.String()
+	}
+	if e.cause == nil {
+		return msg
+	}
+	return msg + ": " + e.cause.Error()
+}
+
+// Is matches a Code target against the error code, so that
+// errors.Is(err, CodeNotFound) works through any wrapping.
+func (e *Error) Is(target error) bool {
+	code, ok := target.(Code)
+	return ok && e.code == code
+}
+
+// Format supports %s, %q and %v for the message, %+v additionally prints
+// the code, the fields, the stack and the cause chain in detail.
+func (e *Error) Format(st fmt.State, verb rune) {
+	switch verb {
+	case 'v':
+		if st.Flag('+') {
+			msg := e.msg
+			if msg == "" {
+				msg = e.code.String()
+			}
+			fmt.Fprintf(st, "[%s] %s", e.code, msg)
+			for _, f := range e.fields {
+				fmt.Fprintf(st, " %s=%v", f.Key, f.Value)
+			}
+			e.stack.Format(st, verb)
+			if e.cause != nil {
+				fmt.Fprintf(st, "\ncaused by: %+v", e.cause)
+			}
+			return
+		}
+		fallthrough
+	case 's':
+		io.WriteString(st, e.Error())
+	case 'q':
+		fmt.Fprintf(st, "%q", e.Error())
+	}
+}
+
+// CodeOf returns the code of the first *Error found in err's tree,
+// CodeUnknown if there is none.
+func CodeOf(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return CodeUnknown
+}
+
+// FieldsOf collects the fields of every *Error in err's tree, including
+// errors accumulated in a MultiError. Outer errors take precedence over
+// the errors they wrap when the same key is set twice.
+func FieldsOf(err error) map[string]any {
+	fields := make(map[string]any)
+	collectFields(err, fields)
+	return fields
+}
+
+func collectFields(err error, fields map[string]any) {
+	for err != nil {
+		if e, ok := err.(*Error); ok {
+			for _, f := range e.fields {
+				if _, ok := fields[f.Key]; !ok {
+					fields[f.Key] = f.Value
+				}
+			}
+		}
+
+		switch u := err.(type) {
+		case interface{ Unwrap() []error }:
+			for _, e := range u.Unwrap() {
+				collectFields(e, fields)
+			}
+			return
+		case interface{ Unwrap() error }:
+			err = u.Unwrap()
+		default:
+			return
+		}
+	}
+}
+
+func findUser(id int) error {
+	if id <= 0 {
+		return New(CodeInvalidArgument, "invalid user id").With("id", id)
+	}
+	return With(Wrap(os.ErrNotExist, CodeNotFound, "user not found"), "id", id)
+}
+
+func TestError(t *testing.T) {
+	err := findUser(42)
+	assert.EqualError(t, err, "user not found: file does not exist")
+	assert.True(t, errors.Is(err, CodeNotFound))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.False(t, errors.Is(err, CodeInternal))
+	assert.Equal(t, CodeNotFound, CodeOf(err))
+	assert.Equal(t, CodeUnknown, CodeOf(os.ErrNotExist))
+
+	var e *Error
+	assert.True(t, errors.As(fmt.Errorf("handler: %w", err), &e))
+	assert.Equal(t, "user not found", e.Message())
+	assert.Equal(t, []Field{{Key: "id", Value: 42}}, e.Fields())
+}
+
+// closeUser needs no nil check: Wrap and With return nil for nil.
+func closeUser(err error) error {
+	return With(Wrap(err, CodeInternal, "close"), "id", 1)
+}
+
+func TestError_Wrap(t *testing.T) {
+	var err error = Wrap(nil, CodeInternal, "nothing")
+	assert.True(t, err == nil)
+	err = Wrapf(nil, CodeInternal, "nothing %d", 1)
+	assert.True(t, err == nil)
+	err = With(nil, "id", 1)
+	assert.True(t, err == nil)
+
+	err = closeUser(nil)
+	assert.True(t, err == nil)
+	err = closeUser(io.ErrClosedPipe)
+	assert.EqualError(t, err, "close: io: read/write on closed pipe")
+	assert.Equal(t, map[string]any{"id": 1}, FieldsOf(err))
+
+	// a plain error is wrapped keeping its code.
+	err = With(fmt.Errorf("retry: %w", New(CodeTimeout, "slow")), "attempt", 2)
+	assert.EqualError(t, err, "timeout: retry: slow")
+	assert.Equal(t, CodeTimeout, CodeOf(err))
+	assert.Equal(t, map[string]any{"attempt": 2}, FieldsOf(err))
+
+	inner := New(CodeTimeout, "").With("attempt", 1)
+	outer := With(Wrapf(inner, CodeUnavailable, "call %s", "billing"), "attempt", 3, "service", "billing")
+
+	assert.EqualError(t, outer, "call billing: timeout")
+	assert.Equal(t, CodeUnavailable, CodeOf(outer))
+	assert.True(t, errors.Is(outer, CodeTimeout))
+	assert.Equal(t, map[string]any{"attempt": 3, "service": "billing"}, FieldsOf(outer))
+}
+
+func TestError_WithIsImmutable(t *testing.T) {
+	base := New(CodeInternal, "base")
+	a := base.With("a", 1)
+	b := base.With("b")
+
+	assert.Empty(t, base.Fields())
+	assert.Equal(t, []Field{{Key: "a", Value: 1}}, a.Fields())
+	assert.Equal(t, []Field{{Key: "b"}}, b.Fields())
+}
+
+func TestError_Format(t *testing.T) {
+	err := With(Wrap(errors.New("connection refused"), CodeUnavailable, "dial"), "host", "db")
+
+	assert.Equal(t, "dial: connection refused", fmt.Sprintf("%s", err))
+	assert.Equal(t, "dial: connection refused", fmt.Sprintf("%v", err))
+	assert.Equal(t, `"dial: connection refused"`, fmt.Sprintf("%q", err))
+
+	detailed := fmt.Sprintf("%+v", err)
+	assert.True(t, strings.HasPrefix(detailed, "[unavailable] dial host=db\n"))
+	assert.Contains(t, detailed, "TestError_Format")
+	assert.Contains(t, detailed, "structured_test.go:")
+	assert.True(t, strings.HasSuffix(detailed, "caused by: connection refused"))
+}
+
+func TestError_Stack(t *testing.T) {
+	err := findUser(0)
+
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	frames := e.Stack().Frames()
+	assert.NotEmpty(t, frames)
+	assert.True(t, strings.HasSuffix(frames[0].Function, ".findUser"))
+}
+
+func TestError_MultiError(t *testing.T) {
+	var err error
+	err = Append(err, findUser(0))
+	err = Append(err, findUser(7))
+
+	assert.True(t, errors.Is(err, CodeInvalidArgument))
+	assert.True(t, errors.Is(err, CodeNotFound))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.Equal(t, CodeInvalidArgument, CodeOf(err))
+
+	wrapped := With(Wrap(err, CodeInternal, "batch failed"), "batch", "b1")
+	assert.Equal(t, CodeInternal, CodeOf(wrapped))
+	assert.True(t, errors.Is(wrapped, CodeNotFound))
+
+	fields := FieldsOf(wrapped)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	assert.Equal(t, []string{"batch", "id"}, keys)
+	assert.Equal(t, 0, fields["id"])
+}
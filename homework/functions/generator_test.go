@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v homework_test.go iter_test.go generator_test.go
+
+type number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 |
+		~float32 | ~float64
+}
+
+// Range yields start, start+step, ... up to stop exclusive. A negative
+// step counts down, a zero step panics. The sequence ends instead of
+// wrapping around when the next value overflows T.
+func Range[T number](start, stop, step T) iter.Seq[T] {
+	if step == 0 {
+		panic("range step must not be zero")
+	}
+
+	return func(yield func(T) bool) {
+		for v := start; (step > 0 && v < stop) || (step < 0 && v > stop); {
+			if !yield(v) {
+				return
+			}
+
+			next := v + step
+			if (step > 0 && next <= v) || (step < 0 && next >= v) {
+				return // overflow, or a float step too small to move v.
+			}
+			v = next
+		}
+	}
+}
+
+// Iterate yields seed, next(seed), next(next(seed)), ... forever.
+func Iterate[T any](seed T, next func(T) T) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for v := seed; yield(v); v = next(v) {
+		}
+	}
+}
+
+// FromFunc turns a generator function like func() int into an infinite
+// sequence.
+func FromFunc[T any](next func() T) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for yield(next()) {
+		}
+	}
+}
+
+// FromPull turns a pull-style iterator, e.g. the one returned by
+// iter.Pull, back into a push-style sequence. The sequence ends when next
+// reports false.
+func FromPull[T any](next func() (T, bool)) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for {
+			v, ok := next()
+			if !ok || !yield(v) {
+				return
+			}
+		}
+	}
+}
+
+// Random yields an infinite stream of pseudo-random numbers in [0, n).
+// The same seed always gives the same stream.
+func Random(seed uint64, n int) iter.Seq[int] {
+	return func(yield func(int) bool) {
+		rnd := rand.New(rand.NewPCG(seed, seed))
+		for yield(rnd.IntN(n)) {
+		}
+	}
+}
+
+// LCG is the linear congruential generator from the random_generator lesson.
+func LCG(seed int) iter.Seq[int] {
+	return Skip(Iterate(seed, func(v int) int {
+		return (1664525*v + 1013904223) % 2147483647
+	}), 1)
+}
+
+// Lines yields the lines of r without the line endings. A read error is
+// yielded once as the last pair, with an empty line.
+func Lines(r io.Reader) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			if !yield(scanner.Text(), nil) {
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			yield("", err)
+		}
+	}
+}
+
+// WithContext stops the sequence once ctx is done. The context is checked
+// before every value, so a blocked source is not interrupted: see Chan.
+func WithContext[T any](ctx context.Context, seq iter.Seq[T]) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		if ctx.Err() != nil {
+			return
+		}
+		for v := range seq {
+			if !yield(v) || ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// Chan runs seq in a goroutine and sends the values to the returned
+// channel, which is closed when seq ends or ctx is done. The goroutine
+// exits as soon as ctx is done even if nobody reads the channel.
+func Chan[T any](ctx context.Context, seq iter.Seq[T]) <-chan T {
+	ch := make(chan T)
+	go func() {
+		defer close(ch)
+		for v := range seq {
+			select {
+			case ch <- v:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// FromChan yields the values received from ch until it is closed or ctx is
+// done, a blocked receive is interrupted by the cancellation.
+func FromChan[T any](ctx context.Context, ch <-chan T) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for {
+			select {
+			case v, ok := <-ch:
+				if !ok || !yield(v) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	tests := map[string]struct {
+		seq    iter.Seq[int]
+		result []int
+	}{
+		"up":    {seq: Range(0, 5, 1), result: []int{0, 1, 2, 3, 4}},
+		"step":  {seq: Range(1, 10, 3), result: []int{1, 4, 7}},
+		"down":  {seq: Range(5, 0, -2), result: []int{5, 3, 1}},
+		"empty": {seq: Range(5, 5, 1)},
+		"wrong direction": {
+			seq: Range(0, 5, -1),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.result, Collect(test.seq))
+		})
+	}
+
+	assert.Equal(t, []float64{0, 0.25, 0.5, 0.75}, Collect(Range(0, 1, 0.25)))
+	assert.Panics(t, func() { Range(0, 1, 0) })
+}
+
+func TestRange_Overflow(t *testing.T) {
+	assert.Equal(t, []int8{0, 100}, Collect(Range[int8](0, 127, 100)))
+	assert.Equal(t, []int8{-128, -28, 72}, Collect(Range[int8](-128, 127, 100)))
+	assert.Equal(t, []int8{0, -100}, Collect(Range[int8](0, -128, -100)))
+	assert.Equal(t, []uint8{250}, Collect(Range[uint8](250, 255, 10)))
+	assert.Len(t, Collect(Range[uint8](0, 255, 1)), 255)
+
+	// the stops near the maximum value.
+	assert.Equal(t, []int64{math.MaxInt64 - 2, math.MaxInt64 - 1}, Collect(Range[int64](math.MaxInt64-2, math.MaxInt64, 1)))
+	assert.Equal(t, []int{math.MaxInt - 1}, Collect(Range(math.MaxInt-1, math.MaxInt, 5)))
+	assert.Equal(t, []uint64{math.MaxUint64 - 3}, Collect(Range[uint64](math.MaxUint64-3, math.MaxUint64, 3)))
+	assert.Equal(t, []int{math.MinInt + 1}, Collect(Range(math.MinInt+1, math.MinInt, -2)))
+}
+
+func TestIterate(t *testing.T) {
+	powers := Collect(Take(Iterate(1, func(v int) int { return v * 2 }), 5))
+	assert.Equal(t, []int{1, 2, 4, 8, 16}, powers)
+
+	counter := 100
+	generator := func() int { // the generator lesson.
+		r := counter
+		counter++
+		return r
+	}
+	assert.Equal(t, []int{100, 101, 102}, Collect(Take(FromFunc(generator), 3)))
+	assert.Equal(t, 103, counter) // Take doesn't call the generator more than needed.
+}
+
+func TestRandom(t *testing.T) {
+	first := Collect(Take(Random(42, 100), 10))
+	second := Collect(Take(Random(42, 100), 10))
+	other := Collect(Take(Random(7, 100), 10))
+
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, other)
+	for _, v := range first {
+		assert.True(t, v >= 0 && v < 100)
+	}
+
+	assert.Equal(t, []int{1015568748, 1586792639, 321897341}, Collect(Take(LCG(1), 3)))
+}
+
+func TestLines(t *testing.T) {
+	var lines []string
+	for line, err := range Lines(strings.NewReader("first\nsecond\r\nthird")) {
+		assert.NoError(t, err)
+		lines = append(lines, line)
+	}
+	assert.Equal(t, []string{"first", "second", "third"}, lines)
+
+	errBroken := errors.New("broken pipe")
+	r := io.MultiReader(strings.NewReader("first\n"), iotest.ErrReader(errBroken))
+
+	var errs []error
+	lines = nil
+	for line, err := range Lines(r) {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		lines = append(lines, line)
+	}
+	assert.Equal(t, []string{"first"}, lines)
+	assert.Equal(t, []error{errBroken}, errs)
+}
+
+func TestPull(t *testing.T) {
+	next, stop := iter.Pull(Range(0, 3, 1))
+	defer stop()
+
+	v, ok := next()
+	assert.True(t, ok)
+	assert.Equal(t, 0, v)
+
+	// the rest can be consumed as a push sequence again.
+	assert.Equal(t, []int{1, 2}, Collect(FromPull(next)))
+
+	_, ok = next()
+	assert.False(t, ok)
+
+	// merging two sorted sequences needs the pull style.
+	lhs, stopL := iter.Pull(Values([]int{1, 4, 9}))
+	defer stopL()
+	rhs, stopR := iter.Pull(Values([]int{2, 3, 10, 11}))
+	defer stopR()
+
+	var merged []int
+	l, lok := lhs()
+	r, rok := rhs()
+	for lok || rok {
+		if !rok || (lok && l <= r) {
+			merged = append(merged, l)
+			l, lok = lhs()
+		} else {
+			merged = append(merged, r)
+			r, rok = rhs()
+		}
+	}
+	assert.Equal(t, []int{1, 2, 3, 4, 9, 10, 11}, merged)
+}
+
+func waitGoroutines(t *testing.T, n int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked: %d, expected %d", runtime.NumGoroutine(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var result []int
+	for v := range WithContext(ctx, naturals()) {
+		result = append(result, v)
+		if v == 3 {
+			cancel()
+		}
+	}
+	assert.Equal(t, []int{1, 2, 3}, result)
+	assert.Nil(t, Collect(WithContext(ctx, naturals())))
+}
+
+func TestChan(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := Chan(ctx, naturals())
+	assert.Equal(t, 1, <-ch)
+	assert.Equal(t, 2, <-ch)
+
+	cancel() // nobody reads the channel anymore.
+	waitGoroutines(t, before)
+
+	ch = Chan(context.Background(), Range(0, 3, 1))
+	assert.Equal(t, []int{0, 1, 2}, Collect(FromChan(context.Background(), ch)))
+	waitGoroutines(t, before)
+}
+
+func TestFromChan(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	ch := make(chan int) // never sends.
+	assert.Nil(t, Collect(FromChan(ctx, ch)))
+
+	before := runtime.NumGoroutine()
+	for l := range Zip(naturals(), naturals()) {
+		if l == 3 {
+			break
+		}
+	}
+	waitGoroutines(t, before) // Zip stops its iter.Pull coroutine.
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"iter"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v homework_test.go iter_test.go
+// go test -bench=. homework_test.go iter_test.go
+
+// The functions below build lazy pipelines over iter.Seq: nothing runs
+// until a terminal function (Collect, Fold, ...) or a range loop pulls
+// the values, and every value goes through all the stages before the
+// next one is read, so no intermediate slices are allocated.
+
+// Values returns a sequence over the slice elements.
+func Values[T any](src []T) iter.Seq[T] {
+	return slices.Values(src)
+}
+
+func MapSeq[T, U any](seq iter.Seq[T], action func(T) U) iter.Seq[U] {
+	return func(yield func(U) bool) {
+		for v := range seq {
+			if !yield(action(v)) {
+				return
+			}
+		}
+	}
+}
+
+func FilterSeq[T any](seq iter.Seq[T], action func(T) bool) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for v := range seq {
+			if action(v) && !yield(v) {
+				return
+			}
+		}
+	}
+}
+
+func FlatMapSeq[T, U any](seq iter.Seq[T], action func(T) iter.Seq[U]) iter.Seq[U] {
+	return func(yield func(U) bool) {
+		for v := range seq {
+			for u := range action(v) {
+				if !yield(u) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Take yields at most n first values and stops pulling the source after that.
+func Take[T any](seq iter.Seq[T], n int) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		if n <= 0 {
+			return
+		}
+
+		taken := 0
+		for v := range seq {
+			if !yield(v) {
+				return
+			}
+			if taken++; taken == n {
+				return
+			}
+		}
+	}
+}
+
+// Skip drops n first values.
+func Skip[T any](seq iter.Seq[T], n int) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		skipped := 0
+		for v := range seq {
+			if skipped < n {
+				skipped++
+				continue
+			}
+			if !yield(v) {
+				return
+			}
+		}
+	}
+}
+
+// Chunk groups values into slices of size elements, the last chunk may
+// be shorter. Every chunk is a new slice, so it can be retained.
+func Chunk[T any](seq iter.Seq[T], size int) iter.Seq[[]T] {
+	if size <= 0 {
+		panic("chunk size must be positive")
+	}
+
+	return func(yield func([]T) bool) {
+		chunk := make([]T, 0, size)
+		for v := range seq {
+			chunk = append(chunk, v)
+			if len(chunk) == size {
+				if !yield(chunk) {
+					return
+				}
+				chunk = make([]T, 0, size)
+			}
+		}
+		if len(chunk) > 0 {
+			yield(chunk)
+		}
+	}
+}
+
+// Window yields sliding windows of size consecutive values. Nothing is
+// yielded if the sequence is shorter than size. Every window is a new
+// slice, so it can be retained.
+func Window[T any](seq iter.Seq[T], size int) iter.Seq[[]T] {
+	if size <= 0 {
+		panic("window size must be positive")
+	}
+
+	return func(yield func([]T) bool) {
+		buf := make([]T, 0, size)
+		for v := range seq {
+			if len(buf) == size {
+				copy(buf, buf[1:])
+				buf = buf[:size-1]
+			}
+			buf = append(buf, v)
+			if len(buf) == size && !yield(slices.Clone(buf)) {
+				return
+			}
+		}
+	}
+}
+
+// Zip pairs the values of both sequences and stops at the shorter one.
+func Zip[T, U any](lhs iter.Seq[T], rhs iter.Seq[U]) iter.Seq2[T, U] {
+	return func(yield func(T, U) bool) {
+		next, stop := iter.Pull(rhs)
+		defer stop()
+
+		for l := range lhs {
+			r, ok := next()
+			if !ok || !yield(l, r) {
+				return
+			}
+		}
+	}
+}
+
+// Distinct yields only the first occurrence of every value.
+func Distinct[T comparable](seq iter.Seq[T]) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		seen := make(map[T]struct{})
+		for v := range seq {
+			if _, ok := seen[v]; ok {
+				continue
+			}
+			seen[v] = struct{}{}
+			if !yield(v) {
+				return
+			}
+		}
+	}
+}
+
+// Terminal functions: they consume the whole sequence.
+
+// Collect returns the values as a slice, nil for an empty sequence.
+func Collect[T any](seq iter.Seq[T]) []T {
+	var dst []T
+	for v := range seq {
+		dst = append(dst, v)
+	}
+	return dst
+}
+
+func Fold[T, A any](seq iter.Seq[T], initial A, action func(A, T) A) A {
+	res := initial
+	for v := range seq {
+		res = action(res, v)
+	}
+	return res
+}
+
+func Count[T any](seq iter.Seq[T]) int {
+	n := 0
+	for range seq {
+		n++
+	}
+	return n
+}
+
+// First returns the first value, it doesn't pull the rest of the sequence.
+func First[T any](seq iter.Seq[T]) (T, bool) {
+	for v := range seq {
+		return v, true
+	}
+	var zero T
+	return zero, false
+}
+
+// GroupBy groups values by key, keeping their order inside the groups.
+func GroupBy[T any, K comparable](seq iter.Seq[T], key func(T) K) map[K][]T {
+	groups := make(map[K][]T)
+	for v := range seq {
+		k := key(v)
+		groups[k] = append(groups[k], v)
+	}
+	return groups
+}
+
+// CollectMap builds a map from a sequence of pairs, later keys win.
+func CollectMap[K comparable, V any](seq iter.Seq2[K, V]) map[K]V {
+	dst := make(map[K]V)
+	for k, v := range seq {
+		dst[k] = v
+	}
+	return dst
+}
+
+// naturals is an infinite sequence: only lazy stages can work with it.
+func naturals() iter.Seq[int] {
+	return func(yield func(int) bool) {
+		for i := 1; ; i++ {
+			if !yield(i) {
+				return
+			}
+		}
+	}
+}
+
+func TestSeqPipeline(t *testing.T) {
+	var pulled int
+	src := MapSeq(naturals(), func(v int) int {
+		pulled++
+		return v
+	})
+
+	even := FilterSeq(src, func(v int) bool { return v%2 == 0 })
+	result := Collect(MapSeq(Take(even, 3), strconv.Itoa))
+
+	assert.Equal(t, []string{"2", "4", "6"}, result)
+	assert.Equal(t, 6, pulled)
+}
+
+func TestSeqStages(t *testing.T) {
+	tests := map[string]struct {
+		seq    iter.Seq[int]
+		result []int
+	}{
+		"nil source": {
+			seq: FilterSeq(Values[int](nil), func(int) bool { return true }),
+		},
+		"flat map": {
+			seq: FlatMapSeq(Values([]int{1, 2, 3}), func(v int) iter.Seq[int] {
+				return Take(naturals(), v)
+			}),
+			result: []int{1, 1, 2, 1, 2, 3},
+		},
+		"take zero": {
+			seq: Take(naturals(), 0),
+		},
+		"take more than available": {
+			seq:    Take(Values([]int{1, 2}), 5),
+			result: []int{1, 2},
+		},
+		"skip": {
+			seq:    Take(Skip(naturals(), 3), 2),
+			result: []int{4, 5},
+		},
+		"skip everything": {
+			seq: Skip(Values([]int{1, 2}), 5),
+		},
+		"distinct": {
+			seq:    Distinct(Values([]int{3, 1, 3, 2, 1, 4})),
+			result: []int{3, 1, 2, 4},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.result, Collect(test.seq))
+		})
+	}
+}
+
+func TestChunkAndWindow(t *testing.T) {
+	chunks := Collect(Chunk(Take(naturals(), 7), 3))
+	assert.Equal(t, [][]int{{1, 2, 3}, {4, 5, 6}, {7}}, chunks)
+
+	windows := Collect(Window(Take(naturals(), 5), 3))
+	assert.Equal(t, [][]int{{1, 2, 3}, {2, 3, 4}, {3, 4, 5}}, windows)
+
+	assert.Nil(t, Collect(Window(Values([]int{1, 2}), 3)))
+	assert.Equal(t, [][]int{{1, 2}}, Collect(Take(Chunk(naturals(), 2), 1)))
+
+	assert.Panics(t, func() { Chunk(naturals(), 0) })
+	assert.Panics(t, func() { Window(naturals(), -1) })
+}
+
+func TestZip(t *testing.T) {
+	letters := Values([]string{"a", "b", "c"})
+	zipped := CollectMap(Zip(letters, naturals()))
+	assert.Equal(t, map[string]int{"a": 1, "b": 2, "c": 3}, zipped)
+
+	var pairs []string
+	for l, n := range Zip(naturals(), letters) {
+		if l == 2 {
+			break
+		}
+		pairs = append(pairs, n+strconv.Itoa(l))
+	}
+	assert.Equal(t, []string{"a1"}, pairs)
+}
+
+func TestTerminals(t *testing.T) {
+	words := Values([]string{"go", "rust", "c", "zig", "java"})
+
+	groups := GroupBy(words, func(w string) int { return len(w) })
+	assert.Equal(t, map[int][]string{1: {"c"}, 2: {"go"}, 3: {"zig"}, 4: {"rust", "java"}}, groups)
+
+	total := Fold(words, 0, func(acc int, w string) int { return acc + len(w) })
+	assert.Equal(t, 14, total)
+	assert.Equal(t, 5, Count(words))
+
+	first, ok := First(FilterSeq(naturals(), func(v int) bool { return v > 10 }))
+	assert.True(t, ok)
+	assert.Equal(t, 11, first)
+
+	_, ok = First(Values[int](nil))
+	assert.False(t, ok)
+}
+
+var (
+	benchData = func() []int {
+		data := make([]int, 100_000)
+		for i := range data {
+			data[i] = i
+		}
+		return data
+	}()
+
+	benchSink int
+)
+
+func BenchmarkEager(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		squares := Map(benchData, func(v int) int { return v * v })
+		even := Filter(squares, func(v int) bool { return v%2 == 0 })
+		benchSink = Reduce(even, 0, func(lhs, rhs int) int { return lhs + rhs })
+	}
+}
+
+func BenchmarkLazy(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		squares := MapSeq(Values(benchData), func(v int) int { return v * v })
+		even := FilterSeq(squares, func(v int) bool { return v%2 == 0 })
+		benchSink = Fold(even, 0, func(lhs, rhs int) int { return lhs + rhs })
+	}
+}
+
+func BenchmarkEager_Take(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		squares := Map(benchData, func(v int) int { return v * v })
+		even := Filter(squares, func(v int) bool { return v%2 == 0 })
+		benchSink = Reduce(even[:10], 0, func(lhs, rhs int) int { return lhs + rhs })
+	}
+}
+
+func BenchmarkLazy_Take(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		squares := MapSeq(Values(benchData), func(v int) int { return v * v })
+		even := FilterSeq(squares, func(v int) bool { return v%2 == 0 })
+		benchSink = Fold(Take(even, 10), 0, func(lhs, rhs int) int { return lhs + rhs })
+	}
+}
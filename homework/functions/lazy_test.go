@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v homework_test.go parallel_test.go middleware_test.go pipeline_test.go lazy_test.go
+
+type lazyResult[T any] struct {
+	value   T
+	err     error
+	expires time.Time // used by Refreshing.
+}
+
+// LazyErr calls init on the first Get and returns its result afterwards.
+// Concurrent first calls wait for a single init call. If retry is set, a
+// failed init is not remembered and the next Get calls init again,
+// otherwise the error is returned forever (until Reset).
+// A panic in init is propagated and the next Get calls init again.
+type LazyErr[T any] struct {
+	init  func() (T, error)
+	retry bool
+
+	mu     sync.Mutex
+	result atomic.Pointer[lazyResult[T]]
+}
+
+func NewLazyErr[T any](init func() (T, error), retry bool) *LazyErr[T] {
+	return &LazyErr[T]{init: init, retry: retry}
+}
+
+func (l *LazyErr[T]) Get() (T, error) {
+	if r := l.result.Load(); r != nil { // fast path without locking.
+		return r.value, r.err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if r := l.result.Load(); r != nil {
+		return r.value, r.err
+	}
+
+	value, err := l.init()
+	if err != nil && l.retry {
+		var zero T
+		return zero, err
+	}
+	l.result.Store(&lazyResult[T]{value: value, err: err})
+	return value, err
+}
+
+// Initialized reports whether the result is remembered.
+func (l *LazyErr[T]) Initialized() bool {
+	return l.result.Load() != nil
+}
+
+// Reset forgets the result, the next Get calls init again. Get calls that
+// have already started may still return the old result.
+func (l *LazyErr[T]) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.result.Store(nil)
+}
+
+// Lazy is LazyErr for initializers that can't fail.
+type Lazy[T any] struct {
+	impl LazyErr[T]
+}
+
+func NewLazy[T any](init func() T) *Lazy[T] {
+	return &Lazy[T]{impl: LazyErr[T]{init: func() (T, error) { return init(), nil }}}
+}
+
+func (l *Lazy[T]) Get() T {
+	v, _ := l.impl.Get()
+	return v
+}
+
+func (l *Lazy[T]) Initialized() bool { return l.impl.Initialized() }
+func (l *Lazy[T]) Reset()            { l.impl.Reset() }
+
+// Refreshing is LazyErr whose value expires ttl after it was created:
+// the first Get after that calls init again, while the other callers wait.
+// Errors are never remembered, so a failed refresh is retried by the next Get.
+type Refreshing[T any] struct {
+	init  func() (T, error)
+	ttl   time.Duration
+	clock Clock
+
+	mu     sync.Mutex
+	result atomic.Pointer[lazyResult[T]]
+}
+
+func NewRefreshing[T any](ttl time.Duration, init func() (T, error), clock Clock) *Refreshing[T] {
+	return &Refreshing[T]{init: init, ttl: ttl, clock: clockOrSystem(clock)}
+}
+
+func (r *Refreshing[T]) fresh() (*lazyResult[T], bool) {
+	res := r.result.Load()
+	return res, res != nil && r.clock.Now().Before(res.expires)
+}
+
+func (r *Refreshing[T]) Get() (T, error) {
+	if res, ok := r.fresh(); ok {
+		return res.value, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if res, ok := r.fresh(); ok {
+		return res.value, nil
+	}
+
+	value, err := r.init()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	r.result.Store(&lazyResult[T]{value: value, expires: r.clock.Now().Add(r.ttl)})
+	return value, nil
+}
+
+// Reset expires the value immediately.
+func (r *Refreshing[T]) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.result.Store(nil)
+}
+
+func TestLazy(t *testing.T) {
+	var calls int
+	data := NewLazy(func() map[string]string {
+		calls++
+		return make(map[string]string)
+	})
+	assert.False(t, data.Initialized())
+
+	data.Get()["key"] = "value"
+	assert.True(t, data.Initialized())
+	assert.Equal(t, map[string]string{"key": "value"}, data.Get())
+	assert.Equal(t, 1, calls)
+
+	data.Reset()
+	assert.False(t, data.Initialized())
+	assert.Empty(t, data.Get())
+	assert.Equal(t, 2, calls)
+}
+
+func TestLazy_Concurrent(t *testing.T) {
+	var calls atomic.Int64
+	value := NewLazy(func() int {
+		calls.Add(1)
+		time.Sleep(time.Millisecond)
+		return 42
+	})
+
+	const goroutines = 100
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			if i%10 == 0 {
+				value.Reset()
+			}
+			assert.Equal(t, 42, value.Get())
+		}()
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, calls.Load(), int64(11)) // the first call and at most one per Reset.
+}
+
+func TestLazy_Panic(t *testing.T) {
+	var calls int
+	value := NewLazy(func() int {
+		if calls++; calls == 1 {
+			panic("not ready")
+		}
+		return 1
+	})
+
+	assert.Panics(t, func() { value.Get() })
+	assert.False(t, value.Initialized())
+	assert.Equal(t, 1, value.Get())
+}
+
+func TestLazyErr(t *testing.T) {
+	errNotReady := errors.New("not ready")
+
+	tests := map[string]struct {
+		retry  bool
+		second error
+	}{
+		"remember error": {retry: false, second: errNotReady},
+		"retry on error": {retry: true, second: nil},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var calls int
+			conn := NewLazyErr(func() (string, error) {
+				if calls++; calls == 1 {
+					return "", errNotReady
+				}
+				return "connection", nil
+			}, test.retry)
+
+			_, err := conn.Get()
+			assert.ErrorIs(t, err, errNotReady)
+			assert.Equal(t, !test.retry, conn.Initialized())
+
+			_, err = conn.Get()
+			assert.Equal(t, test.second, err)
+
+			conn.Reset()
+			v, err := conn.Get()
+			assert.NoError(t, err)
+			assert.Equal(t, "connection", v)
+		})
+	}
+}
+
+func TestRefreshing(t *testing.T) {
+	clock := newManualClock()
+	errUnavailable := errors.New("unavailable")
+
+	var calls int
+	var fail error
+	token := NewRefreshing(time.Minute, func() (int, error) {
+		if fail != nil {
+			return 0, fail
+		}
+		calls++
+		return calls, nil
+	}, clock)
+
+	v, err := token.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v)
+
+	clock.Advance(59 * time.Second)
+	v, _ = token.Get()
+	assert.Equal(t, 1, v)
+
+	clock.Advance(time.Second)
+	v, _ = token.Get()
+	assert.Equal(t, 2, v)
+
+	clock.Advance(time.Minute)
+	fail = errUnavailable
+	_, err = token.Get()
+	assert.ErrorIs(t, err, errUnavailable)
+
+	fail = nil
+	v, err = token.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, v)
+
+	token.Reset()
+	v, _ = token.Get()
+	assert.Equal(t, 4, v)
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v homework_test.go memoize_test.go
+
+// Cache is an eviction policy used by Memo. Implementations don't need to
+// be safe for concurrent use, Memo serializes the access.
+type Cache[K comparable, V any] interface {
+	Get(key K) (V, bool)
+	// Set stores the value and returns the number of evicted entries.
+	Set(key K, value V) (evicted int)
+	Len() int
+}
+
+// ErrMemoPanicked is returned to the callers waiting for a call that panicked.
+var ErrMemoPanicked = errors.New("memoized function panicked")
+
+// Stats are the Memo counters.
+type Stats struct {
+	Hits      uint64 // results served from the cache.
+	Misses    uint64 // calls of the wrapped function.
+	Shared    uint64 // calls that waited for the same key already in flight.
+	Evictions uint64
+}
+
+type call[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// Memo wraps a function and caches its results. Concurrent calls with the
+// same key are collapsed into a single call of the function (singleflight).
+// Errors are returned to every waiting caller but are never cached.
+//
+// A memoized function may call its Memo recursively for other keys, a
+// recursive call with the same key deadlocks.
+type Memo[K comparable, V any] struct {
+	fn func(K) (V, error)
+
+	mu       sync.Mutex
+	cache    Cache[K, V]
+	inflight map[K]*call[V]
+
+	hits, misses, shared, evictions atomic.Uint64
+}
+
+// Memoize wraps fn with the given cache, a nil cache keeps every result.
+func Memoize[K comparable, V any](fn func(K) (V, error), cache Cache[K, V]) *Memo[K, V] {
+	if cache == nil {
+		cache = NewUnbounded[K, V]()
+	}
+	return &Memo[K, V]{
+		fn:       fn,
+		cache:    cache,
+		inflight: make(map[K]*call[V]),
+	}
+}
+
+// MemoizeFunc is Memoize for functions that can't fail.
+func MemoizeFunc[K comparable, V any](fn func(K) V, cache Cache[K, V]) func(K) V {
+	m := Memoize(func(key K) (V, error) { return fn(key), nil }, cache)
+	return func(key K) V {
+		v, _ := m.Get(key)
+		return v
+	}
+}
+
+func (m *Memo[K, V]) Get(key K) (V, error) {
+	m.mu.Lock()
+	if v, ok := m.cache.Get(key); ok {
+		m.mu.Unlock()
+		m.hits.Add(1)
+		return v, nil
+	}
+	if c, ok := m.inflight[key]; ok {
+		m.mu.Unlock()
+		m.shared.Add(1)
+		<-c.done
+		return c.value, c.err
+	}
+
+	c := &call[V]{done: make(chan struct{})}
+	m.inflight[key] = c
+	m.mu.Unlock()
+	m.misses.Add(1)
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.inflight, key)
+		if c.err == nil {
+			m.evictions.Add(uint64(m.cache.Set(key, c.value)))
+		}
+		m.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.err = ErrMemoPanicked // overwritten unless fn panics.
+	c.value, c.err = m.fn(key)
+	return c.value, c.err
+}
+
+func (m *Memo[K, V]) Stats() Stats {
+	return Stats{
+		Hits:      m.hits.Load(),
+		Misses:    m.misses.Load(),
+		Shared:    m.shared.Load(),
+		Evictions: m.evictions.Load(),
+	}
+}
+
+func (m *Memo[K, V]) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cache.Len()
+}
+
+// Unbounded keeps every value forever.
+type Unbounded[K comparable, V any] map[K]V
+
+func NewUnbounded[K comparable, V any]() Unbounded[K, V] {
+	return make(Unbounded[K, V])
+}
+
+func (c Unbounded[K, V]) Get(key K) (V, bool) {
+	v, ok := c[key]
+	return v, ok
+}
+
+func (c Unbounded[K, V]) Set(key K, value V) int {
+	c[key] = value
+	return 0
+}
+
+func (c Unbounded[K, V]) Len() int {
+	return len(c)
+}
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	freq    int       // used by LFU.
+	expires time.Time // used by TTL.
+}
+
+// LRU evicts the least recently used entry when full.
+type LRU[K comparable, V any] struct {
+	capacity int
+	order    *list.List // front is the most recently used.
+	items    map[K]*list.Element
+}
+
+func NewLRU[K comparable, V any](capacity int) *LRU[K, V] {
+	if capacity <= 0 {
+		panic("capacity must be positive")
+	}
+	return &LRU[K, V]{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[K]*list.Element, capacity),
+	}
+}
+
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*entry[K, V]).value, true
+}
+
+func (c *LRU[K, V]) Set(key K, value V) int {
+	if el, ok := c.items[key]; ok {
+		el.Value.(*entry[K, V]).value = value
+		c.order.MoveToFront(el)
+		return 0
+	}
+
+	evicted := 0
+	if c.order.Len() == c.capacity {
+		last := c.order.Back()
+		delete(c.items, c.order.Remove(last).(*entry[K, V]).key)
+		evicted++
+	}
+	c.items[key] = c.order.PushFront(&entry[K, V]{key: key, value: value})
+	return evicted
+}
+
+func (c *LRU[K, V]) Len() int {
+	return c.order.Len()
+}
+
+// LFU evicts the least frequently used entry when full, ties are broken
+// by evicting the least recently used one. All operations are O(1).
+type LFU[K comparable, V any] struct {
+	capacity int
+	minFreq  int
+	items    map[K]*list.Element
+	freqs    map[int]*list.List // frequency -> entries, front is the most recent.
+}
+
+func NewLFU[K comparable, V any](capacity int) *LFU[K, V] {
+	if capacity <= 0 {
+		panic("capacity must be positive")
+	}
+	return &LFU[K, V]{
+		capacity: capacity,
+		items:    make(map[K]*list.Element, capacity),
+		freqs:    make(map[int]*list.List),
+	}
+}
+
+func (c *LFU[K, V]) touch(el *list.Element) *list.Element {
+	e := el.Value.(*entry[K, V])
+	bucket := c.freqs[e.freq]
+	bucket.Remove(el)
+	if bucket.Len() == 0 {
+		delete(c.freqs, e.freq)
+		if c.minFreq == e.freq {
+			c.minFreq++
+		}
+	}
+
+	e.freq++
+	return c.push(e)
+}
+
+func (c *LFU[K, V]) push(e *entry[K, V]) *list.Element {
+	bucket, ok := c.freqs[e.freq]
+	if !ok {
+		bucket = list.New()
+		c.freqs[e.freq] = bucket
+	}
+	el := bucket.PushFront(e)
+	c.items[e.key] = el
+	return el
+}
+
+func (c *LFU[K, V]) Get(key K) (V, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return c.touch(el).Value.(*entry[K, V]).value, true
+}
+
+func (c *LFU[K, V]) Set(key K, value V) int {
+	if el, ok := c.items[key]; ok {
+		c.touch(el).Value.(*entry[K, V]).value = value
+		return 0
+	}
+
+	evicted := 0
+	if len(c.items) == c.capacity {
+		bucket := c.freqs[c.minFreq]
+		e := bucket.Remove(bucket.Back()).(*entry[K, V])
+		if bucket.Len() == 0 {
+			delete(c.freqs, c.minFreq)
+		}
+		delete(c.items, e.key)
+		evicted++
+	}
+
+	c.minFreq = 1
+	c.push(&entry[K, V]{key: key, value: value, freq: 1})
+	return evicted
+}
+
+func (c *LFU[K, V]) Len() int {
+	return len(c.items)
+}
+
+// TTL expires entries ttl after they were set. If capacity is positive,
+// the entry closest to expiration is evicted when full. now is the clock,
+// time.Now if nil.
+type TTL[K comparable, V any] struct {
+	ttl      time.Duration
+	capacity int
+	now      func() time.Time
+	order    *list.List // ordered by expiration, front expires first.
+	items    map[K]*list.Element
+}
+
+func NewTTL[K comparable, V any](ttl time.Duration, capacity int, now func() time.Time) *TTL[K, V] {
+	if now == nil {
+		now = time.Now
+	}
+	return &TTL[K, V]{
+		ttl:      ttl,
+		capacity: capacity,
+		now:      now,
+		order:    list.New(),
+		items:    make(map[K]*list.Element),
+	}
+}
+
+// Get doesn't return expired entries, they are dropped by the next Set.
+func (c *TTL[K, V]) Get(key K) (V, bool) {
+	el, ok := c.items[key]
+	if !ok || !c.now().Before(el.Value.(*entry[K, V]).expires) {
+		var zero V
+		return zero, false
+	}
+	return el.Value.(*entry[K, V]).value, true
+}
+
+func (c *TTL[K, V]) Set(key K, value V) int {
+	now := c.now()
+
+	evicted := 0
+	for el := c.order.Front(); el != nil && !now.Before(el.Value.(*entry[K, V]).expires); el = c.order.Front() {
+		delete(c.items, c.order.Remove(el).(*entry[K, V]).key)
+		evicted++
+	}
+
+	// the ttl is the same for every entry, so setting a key moves it to
+	// the back of the expiration order.
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry[K, V])
+		e.value, e.expires = value, now.Add(c.ttl)
+		c.order.MoveToBack(el)
+		return evicted
+	}
+
+	if c.capacity > 0 && c.order.Len() == c.capacity {
+		delete(c.items, c.order.Remove(c.order.Front()).(*entry[K, V]).key)
+		evicted++
+	}
+	c.items[key] = c.order.PushBack(&entry[K, V]{key: key, value: value, expires: now.Add(c.ttl)})
+	return evicted
+}
+
+func (c *TTL[K, V]) Len() int {
+	return c.order.Len()
+}
+
+func TestMemoize_Fibonacci(t *testing.T) {
+	var fib func(int) int
+	fib = MemoizeFunc(func(n int) int {
+		if n <= 2 {
+			return 1
+		}
+		return fib(n-1) + fib(n-2)
+	}, nil)
+
+	assert.Equal(t, 1, fib(1))
+	assert.Equal(t, 1, fib(2))
+	assert.Equal(t, 55, fib(10))
+	assert.Equal(t, 12586269025, fib(50))
+}
+
+func TestMemoize_Stats(t *testing.T) {
+	var calls int
+	m := Memoize(func(n int) (int, error) {
+		calls++
+		return n * n, nil
+	}, NewLRU[int, int](2))
+
+	for _, n := range []int{1, 2, 1, 3, 2, 1} {
+		v, err := m.Get(n)
+		assert.NoError(t, err)
+		assert.Equal(t, n*n, v)
+	}
+
+	// 1 miss, 2 miss, 1 hit, 3 miss (evicts 2), 2 miss (evicts 1), 1 miss (evicts 3).
+	assert.Equal(t, 5, calls)
+	assert.Equal(t, Stats{Hits: 1, Misses: 5, Evictions: 3}, m.Stats())
+	assert.Equal(t, 2, m.Len())
+}
+
+func TestMemoize_ErrorsAreNotCached(t *testing.T) {
+	errTemporary := errors.New("temporary error")
+
+	var calls int
+	m := Memoize(func(key string) (string, error) {
+		if calls++; calls == 1 {
+			return "", errTemporary
+		}
+		return key + "!", nil
+	}, nil)
+
+	_, err := m.Get("key")
+	assert.ErrorIs(t, err, errTemporary)
+
+	v, err := m.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "key!", v)
+
+	v, err = m.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "key!", v)
+	assert.Equal(t, 2, calls)
+}
+
+func TestMemoize_Singleflight(t *testing.T) {
+	var calls atomic.Int64
+	release := make(chan struct{})
+	m := Memoize(func(key string) (int, error) {
+		calls.Add(1)
+		<-release
+		return len(key), nil
+	}, nil)
+
+	const goroutines = 50
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	results := make([]int, goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			results[i], _ = m.Get("hello")
+		}()
+	}
+
+	// wait until every goroutine is either running the call or waiting for it.
+	for m.Stats().Misses+m.Stats().Shared != goroutines {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int64(1), calls.Load())
+	for _, r := range results {
+		assert.Equal(t, 5, r)
+	}
+	assert.Equal(t, Stats{Misses: 1, Shared: goroutines - 1}, m.Stats())
+}
+
+func TestMemoize_Panic(t *testing.T) {
+	m := Memoize(func(n int) (int, error) {
+		if n == 0 {
+			panic("division by zero")
+		}
+		return 100 / n, nil
+	}, nil)
+
+	assert.Panics(t, func() { m.Get(0) })
+
+	v, err := m.Get(5)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, v)
+	assert.Equal(t, 1, m.Len())
+}
+
+func TestLRU(t *testing.T) {
+	c := NewLRU[string, int](2)
+	assert.Equal(t, 0, c.Set("a", 1))
+	assert.Equal(t, 0, c.Set("b", 2))
+
+	_, ok := c.Get("a") // b becomes the least recently used.
+	assert.True(t, ok)
+	assert.Equal(t, 1, c.Set("c", 3))
+
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Set("a", 10))
+	v, _ := c.Get("a")
+	assert.Equal(t, 10, v)
+	assert.Equal(t, 2, c.Len())
+
+	assert.Panics(t, func() { NewLRU[int, int](0) })
+}
+
+func TestLFU(t *testing.T) {
+	c := NewLFU[string, int](2)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a")
+	c.Get("a")
+	c.Get("b")
+
+	assert.Equal(t, 1, c.Set("c", 3)) // b is used less than a.
+	_, ok := c.Get("b")
+	assert.False(t, ok)
+
+	assert.Equal(t, 1, c.Set("d", 4)) // c and d have the lowest frequency.
+	_, ok = c.Get("c")
+	assert.False(t, ok)
+
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	c.Get("d")
+	assert.Equal(t, 0, c.Set("d", 40))
+	assert.Equal(t, 1, c.Set("e", 5)) // a: 4 uses, d: 3 uses.
+	_, ok = c.Get("d")
+	assert.False(t, ok)
+	assert.Equal(t, 2, c.Len())
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := NewTTL[string, int](time.Minute, 2, clock.Now)
+
+	c.Set("a", 1)
+	clock.Advance(30 * time.Second)
+	c.Set("b", 2)
+
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	clock.Advance(30 * time.Second)
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+	_, ok = c.Get("b")
+	assert.True(t, ok)
+
+	assert.Equal(t, 1, c.Set("c", 3)) // a has expired.
+	assert.Equal(t, 1, c.Set("d", 4)) // full: b is the closest to expiration.
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestMemoize_TTL(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	var calls int
+	m := Memoize(func(key string) (int, error) {
+		calls++
+		return calls, nil
+	}, NewTTL[string, int](time.Second, 0, clock.Now))
+
+	v, _ := m.Get("key")
+	assert.Equal(t, 1, v)
+	v, _ = m.Get("key")
+	assert.Equal(t, 1, v)
+
+	clock.Advance(time.Second)
+	v, _ = m.Get("key")
+	assert.Equal(t, 2, v)
+	assert.Equal(t, Stats{Hits: 1, Misses: 2, Evictions: 1}, m.Stats())
+}
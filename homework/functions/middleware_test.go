@@ -0,0 +1,884 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v homework_test.go parallel_test.go middleware_test.go pipeline_test.go
+
+// Handler is a decorated call with its arguments and results already bound,
+// so middlewares don't depend on the types of the decorated function.
+type Handler func(ctx context.Context) error
+
+// Middleware wraps a Handler with additional behavior.
+type Middleware func(next Handler) Handler
+
+// Decorate wraps fn with the middlewares. The first middleware is the
+// outermost one: Decorate(fn, Logging(...), Retry(...)) logs once for all
+// the retries.
+func Decorate[In, Out any](fn func(context.Context, In) (Out, error), mws ...Middleware) Stage[In, Out] {
+	return func(ctx context.Context, in In) (Out, error) {
+		var out Out
+		h := Handler(func(ctx context.Context) (err error) {
+			out, err = fn(ctx, in)
+			return err
+		})
+		for i := len(mws) - 1; i >= 0; i-- {
+			h = mws[i](h)
+		}
+
+		err := h(ctx)
+		return out, err
+	}
+}
+
+// Chain composes the middlewares into one, the first one is the outermost.
+func Chain(mws ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			next = mws[i](next)
+		}
+		return next
+	}
+}
+
+// Clock is the source of time for the middlewares, so that they can be
+// tested without sleeping.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SystemClock is the real time, middlewares use it when given a nil Clock.
+var SystemClock Clock = systemClock{}
+
+func clockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, clock Clock, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-clock.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Logging logs the outcome and the duration of every call.
+func Logging(logger *log.Logger, name string) Middleware {
+	return LoggingWithClock(logger, name, SystemClock)
+}
+
+// LoggingWithClock is Logging measuring the duration with clock.
+func LoggingWithClock(logger *log.Logger, name string, clock Clock) Middleware {
+	clock = clockOrSystem(clock)
+	return func(next Handler) Handler {
+		return func(ctx context.Context) error {
+			start := clock.Now()
+			err := next(ctx)
+			if err != nil {
+				logger.Printf("%s: failed in %s: %v", name, clock.Now().Sub(start), err)
+			} else {
+				logger.Printf("%s: done in %s", name, clock.Now().Sub(start))
+			}
+			return err
+		}
+	}
+}
+
+// Timing reports the duration and the outcome of every call to observe.
+func Timing(observe func(d time.Duration, err error)) Middleware {
+	return TimingWithClock(observe, SystemClock)
+}
+
+// TimingWithClock is Timing measuring the duration with clock.
+func TimingWithClock(observe func(d time.Duration, err error), clock Clock) Middleware {
+	clock = clockOrSystem(clock)
+	return func(next Handler) Handler {
+		return func(ctx context.Context) error {
+			start := clock.Now()
+			err := next(ctx)
+			observe(clock.Now().Sub(start), err)
+			return err
+		}
+	}
+}
+
+// Backoff returns the delay before the given retry, starting from 1.
+type Backoff func(retry int) time.Duration
+
+func ConstantBackoff(delay time.Duration) Backoff {
+	return func(int) time.Duration {
+		return delay
+	}
+}
+
+// ExponentialBackoff doubles the delay on every retry, up to limit.
+func ExponentialBackoff(base, limit time.Duration) Backoff {
+	return func(retry int) time.Duration {
+		delay := base
+		for i := 1; i < retry && delay < limit; i++ {
+			delay *= 2
+		}
+		return min(delay, limit)
+	}
+}
+
+type RetryPolicy struct {
+	Attempts  int              // total number of calls, at least 1.
+	Backoff   Backoff          // no delay if nil.
+	Retryable func(error) bool // every error is retried if nil.
+	Clock     Clock
+}
+
+// RetryWith calls next until it succeeds, fails with a non-retryable
+// error, runs out of attempts or ctx is done. The last error is returned.
+func RetryWith(policy RetryPolicy) Middleware {
+	clock := clockOrSystem(policy.Clock)
+	return func(next Handler) Handler {
+		return func(ctx context.Context) error {
+			var err error
+			for attempt := 0; attempt < max(1, policy.Attempts); attempt++ {
+				if attempt > 0 {
+					if policy.Retryable != nil && !policy.Retryable(err) {
+						return err
+					}
+
+					var delay time.Duration
+					if policy.Backoff != nil {
+						delay = policy.Backoff(attempt)
+					}
+					if serr := sleep(ctx, clock, delay); serr != nil {
+						return errors.Join(err, serr)
+					}
+				}
+				if err = next(ctx); err == nil {
+					return nil
+				}
+			}
+			return err
+		}
+	}
+}
+
+// Retry calls next up to attempts times with delay between the calls,
+// until it succeeds or ctx is done.
+func Retry(attempts int, delay time.Duration) Middleware {
+	return RetryWith(RetryPolicy{Attempts: attempts, Backoff: ConstantBackoff(delay)})
+}
+
+var ErrTimeout = fmt.Errorf("call timed out: %w", context.DeadlineExceeded)
+
+// Timeout cancels the context passed to next after d. Go can't stop a
+// goroutine from the outside, so the timeout is cooperative: next must
+// return when its context is done. If it still fails after the timeout
+// the error is ErrTimeout joined with the error of next.
+func Timeout(d time.Duration, clock Clock) Middleware {
+	clock = clockOrSystem(clock)
+	return func(next Handler) Handler {
+		return func(ctx context.Context) error {
+			ctx, cancel := context.WithCancelCause(ctx)
+			defer cancel(nil)
+
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-clock.After(d):
+					cancel(ErrTimeout)
+				case <-done:
+				}
+			}()
+
+			err := next(ctx)
+			if err != nil && context.Cause(ctx) == ErrTimeout {
+				return errors.Join(ErrTimeout, err)
+			}
+			return err
+		}
+	}
+}
+
+// Recover turns a panic in next into a *PanicError.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context) (err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					err = &PanicError{Value: v}
+				}
+			}()
+			return next(ctx)
+		}
+	}
+}
+
+var (
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+
+	errHandlerPanic = errors.New("handler panicked")
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker stops calling a failing dependency. After threshold
+// consecutive failures it opens and rejects calls with ErrCircuitOpen.
+// After cooldown it lets a single probe call through (half-open): success
+// closes it, failure opens it for another cooldown. A panic counts as a
+// failure and goes on unwinding.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	clock     Clock
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration, clock Clock) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: max(1, threshold),
+		cooldown:  cooldown,
+		clock:     clockOrSystem(clock),
+	}
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && b.clock.Now().Sub(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && b.clock.Now().Sub(b.openedAt) >= b.cooldown {
+		b.state = BreakerHalfOpen
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+func (b *CircuitBreaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if err == nil {
+		b.state, b.failures = BreakerClosed, 0
+		return
+	}
+
+	if b.failures++; b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state, b.openedAt = BreakerOpen, b.clock.Now()
+	}
+}
+
+func (b *CircuitBreaker) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context) (err error) {
+			if !b.allow() {
+				return ErrCircuitOpen
+			}
+
+			panicked := true
+			defer func() {
+				if panicked {
+					err = errHandlerPanic
+				}
+				b.done(err)
+			}()
+			err = next(ctx)
+			panicked = false
+			return err
+		}
+	}
+}
+
+// RateLimiter is a token bucket: it allows rate calls per second on
+// average and bursts of up to burst calls.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	clock Clock
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter panics if rate isn't positive.
+func NewRateLimiter(rate float64, burst int, clock Clock) *RateLimiter {
+	if !(rate > 0) {
+		panic("rate must be positive")
+	}
+	clock = clockOrSystem(clock)
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(max(1, burst)),
+		clock:  clock,
+		tokens: float64(max(1, burst)),
+		last:   clock.Now(),
+	}
+}
+
+// reserve takes a token and returns how long to wait until it is available.
+func (l *RateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+func (l *RateLimiter) cancel() {
+	l.mu.Lock()
+	l.tokens = min(l.burst, l.tokens+1)
+	l.mu.Unlock()
+}
+
+// Wait blocks until a call is allowed or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if err := sleep(ctx, l.clock, l.reserve()); err != nil {
+		l.cancel()
+		return err
+	}
+	return nil
+}
+
+func (l *RateLimiter) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context) error {
+			if err := l.Wait(ctx); err != nil {
+				return err
+			}
+			return next(ctx)
+		}
+	}
+}
+
+type manualTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// manualClock only moves when Advance is called.
+type manualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []manualTimer
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, manualTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the time forward and fires the timers that are due.
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// BlockUntil waits until n timers are waiting to fire.
+func (c *manualClock) BlockUntil(n int) {
+	for {
+		c.mu.Lock()
+		waiting := len(c.timers)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestDecorate(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context) error {
+				order = append(order, name+" before")
+				err := next(ctx)
+				order = append(order, name+" after")
+				return err
+			}
+		}
+	}
+
+	add := Decorate(func(ctx context.Context, xy [2]int) (int, error) {
+		order = append(order, "call")
+		return xy[0] + xy[1], nil
+	}, trace("outer"), trace("inner"))
+
+	result, err := add(context.Background(), [2]int{10, 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 20, result)
+	assert.Equal(t, []string{"outer before", "inner before", "call", "inner after", "outer after"}, order)
+}
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+
+	errOdd := errors.New("odd number")
+	half := Decorate(func(ctx context.Context, x int) (int, error) {
+		if x%2 != 0 {
+			return 0, errOdd
+		}
+		return x / 2, nil
+	}, Logging(logger, "half"))
+
+	_, _ = half(context.Background(), 10)
+	_, _ = half(context.Background(), 3)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "half: done in "))
+	assert.True(t, strings.HasPrefix(lines[1], "half: failed in "))
+	assert.True(t, strings.HasSuffix(lines[1], ": odd number"))
+
+	clock := newManualClock()
+	buf.Reset()
+	slow := Decorate(func(ctx context.Context, x int) (int, error) {
+		clock.Advance(1500 * time.Millisecond)
+		return x, nil
+	}, LoggingWithClock(logger, "slow", clock))
+
+	_, _ = slow(context.Background(), 1)
+	assert.Equal(t, "slow: done in 1.5s\n", buf.String())
+}
+
+func TestTiming(t *testing.T) {
+	clock := newManualClock()
+
+	var durations []time.Duration
+	sleep := Decorate(func(ctx context.Context, d time.Duration) (struct{}, error) {
+		clock.Advance(d)
+		return struct{}{}, nil
+	}, TimingWithClock(func(d time.Duration, err error) {
+		durations = append(durations, d)
+	}, clock))
+
+	_, _ = sleep(context.Background(), 5*time.Millisecond)
+	_, _ = sleep(context.Background(), time.Second)
+	assert.Equal(t, []time.Duration{5 * time.Millisecond, time.Second}, durations)
+}
+
+func TestRetry(t *testing.T) {
+	errTemporary := errors.New("temporary error")
+
+	var calls int
+	flaky := Decorate(func(ctx context.Context, x int) (int, error) {
+		if calls++; calls < 3 {
+			return 0, errTemporary
+		}
+		return x, nil
+	}, Retry(3, time.Millisecond))
+
+	result, err := flaky(context.Background(), 42)
+	assert.NoError(t, err)
+	assert.Equal(t, 42, result)
+	assert.Equal(t, 3, calls)
+
+	calls = -10
+	_, err = flaky(context.Background(), 42)
+	assert.ErrorIs(t, err, errTemporary)
+	assert.Equal(t, -7, calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = -10
+	_, err = flaky(ctx, 42)
+	assert.ErrorIs(t, err, errTemporary)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, -9, calls)
+}
+
+func TestRetryWith_Backoff(t *testing.T) {
+	clock := newManualClock()
+	errTemporary := errors.New("temporary error")
+	errFatal := errors.New("fatal error")
+
+	var calls []time.Time
+	var fail error
+	fn := Decorate(func(ctx context.Context, x int) (int, error) {
+		calls = append(calls, clock.Now())
+		return x, fail
+	}, RetryWith(RetryPolicy{
+		Attempts:  4,
+		Backoff:   ExponentialBackoff(time.Second, 3*time.Second),
+		Retryable: func(err error) bool { return !errors.Is(err, errFatal) },
+		Clock:     clock,
+	}))
+
+	fail = errTemporary
+	done := make(chan error)
+	go func() {
+		_, err := fn(context.Background(), 1)
+		done <- err
+	}()
+	for _, d := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		clock.BlockUntil(1)
+		clock.Advance(d)
+	}
+	assert.ErrorIs(t, <-done, errTemporary)
+
+	assert.Len(t, calls, 4)
+	start := calls[0]
+	for i, offset := range []time.Duration{0, time.Second, 3 * time.Second, 6 * time.Second} {
+		assert.Equal(t, offset, calls[i].Sub(start))
+	}
+
+	calls, fail = nil, errFatal
+	_, err := fn(context.Background(), 1)
+	assert.ErrorIs(t, err, errFatal)
+	assert.Len(t, calls, 1)
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(100*time.Millisecond, time.Second)
+
+	var delays []time.Duration
+	for retry := 1; retry <= 6; retry++ {
+		delays = append(delays, backoff(retry))
+	}
+	assert.Equal(t, []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}, delays)
+}
+
+func TestTimeout(t *testing.T) {
+	clock := newManualClock()
+
+	wait := Decorate(func(ctx context.Context, x int) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}, Timeout(time.Second, clock))
+
+	done := make(chan error)
+	go func() {
+		_, err := wait(context.Background(), 1)
+		done <- err
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+
+	err := <-done
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	fast := Decorate(func(ctx context.Context, x int) (int, error) {
+		return x * 2, nil
+	}, Timeout(time.Second, clock))
+	result, err := fast(context.Background(), 21)
+	assert.NoError(t, err)
+	assert.Equal(t, 42, result)
+
+	// the parent cancellation is not reported as a timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = wait(ctx, 1)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NotErrorIs(t, err, ErrTimeout)
+}
+
+func TestRecover(t *testing.T) {
+	divide := Decorate(func(ctx context.Context, xy [2]int) (int, error) {
+		return xy[0] / xy[1], nil
+	}, Recover())
+
+	result, err := divide(context.Background(), [2]int{10, 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, result)
+
+	_, err = divide(context.Background(), [2]int{10, 0})
+	var perr *PanicError
+	assert.True(t, errors.As(err, &perr))
+	assert.Contains(t, err.Error(), "integer divide by zero")
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := newManualClock()
+	errUnavailable := errors.New("unavailable")
+
+	breaker := NewCircuitBreaker(2, time.Minute, clock)
+	var calls int
+	var fail error
+	call := Decorate(func(ctx context.Context, x int) (int, error) {
+		calls++
+		return x, fail
+	}, breaker.Middleware())
+	ctx := context.Background()
+
+	fail = errUnavailable
+	_, err := call(ctx, 1)
+	assert.ErrorIs(t, err, errUnavailable)
+	assert.Equal(t, BreakerClosed, breaker.State())
+
+	_, err = call(ctx, 1)
+	assert.ErrorIs(t, err, errUnavailable)
+	assert.Equal(t, BreakerOpen, breaker.State())
+
+	_, err = call(ctx, 1)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 2, calls)
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, BreakerHalfOpen, breaker.State())
+	_, err = call(ctx, 1) // the probe fails: open for another minute.
+	assert.ErrorIs(t, err, errUnavailable)
+	assert.Equal(t, BreakerOpen, breaker.State())
+
+	clock.Advance(30 * time.Second)
+	_, err = call(ctx, 1)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	clock.Advance(30 * time.Second)
+	fail = nil
+	_, err = call(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, BreakerClosed, breaker.State())
+	assert.Equal(t, 4, calls)
+}
+
+func TestCircuitBreaker_SingleProbe(t *testing.T) {
+	clock := newManualClock()
+	breaker := NewCircuitBreaker(1, time.Second, clock)
+
+	release := make(chan struct{})
+	call := Decorate(func(ctx context.Context, fail bool) (int, error) {
+		if fail {
+			return 0, errors.New("failed")
+		}
+		<-release
+		return 1, nil
+	}, breaker.Middleware())
+
+	_, _ = call(context.Background(), true)
+	clock.Advance(time.Second)
+
+	probe := make(chan error)
+	go func() {
+		_, err := call(context.Background(), false)
+		probe <- err
+	}()
+	for !breaker.probingNow() {
+		runtime.Gosched()
+	}
+
+	_, err := call(context.Background(), false)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	close(release)
+	assert.NoError(t, <-probe)
+	assert.Equal(t, BreakerClosed, breaker.State())
+}
+
+func TestCircuitBreaker_Panic(t *testing.T) {
+	clock := newManualClock()
+	breaker := NewCircuitBreaker(1, time.Second, clock)
+
+	call := Decorate(func(ctx context.Context, panics bool) (int, error) {
+		if panics {
+			panic("boom")
+		}
+		return 1, nil
+	}, breaker.Middleware())
+
+	assert.PanicsWithValue(t, "boom", func() { _, _ = call(context.Background(), true) })
+	assert.Equal(t, BreakerOpen, breaker.State())
+
+	clock.Advance(time.Second)
+	assert.PanicsWithValue(t, "boom", func() { _, _ = call(context.Background(), true) })
+	assert.Equal(t, BreakerOpen, breaker.State(), "the panicking probe opens the breaker again")
+	assert.False(t, breaker.probingNow())
+
+	clock.Advance(time.Second)
+	result, err := call(context.Background(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result)
+	assert.Equal(t, BreakerClosed, breaker.State())
+}
+
+func (b *CircuitBreaker) probingNow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.probing
+}
+
+func TestRateLimiter(t *testing.T) {
+	clock := newManualClock()
+	limiter := NewRateLimiter(2, 3, clock) // 2 calls per second, bursts of 3.
+
+	var calls []time.Time
+	call := Decorate(func(ctx context.Context, x int) (int, error) {
+		calls = append(calls, clock.Now())
+		return x, nil
+	}, limiter.Middleware())
+	ctx := context.Background()
+
+	start := clock.Now()
+	for i := 0; i < 3; i++ { // the burst goes through without waiting.
+		_, err := call(ctx, i)
+		assert.NoError(t, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = call(ctx, 3)
+		_, _ = call(ctx, 4)
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(500 * time.Millisecond)
+	clock.BlockUntil(1)
+	clock.Advance(500 * time.Millisecond)
+	<-done
+
+	offsets := make([]time.Duration, len(calls))
+	for i := range calls {
+		offsets[i] = calls[i].Sub(start)
+	}
+	assert.Equal(t, []time.Duration{0, 0, 0, 500 * time.Millisecond, time.Second}, offsets)
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := call(cctx, 5)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, calls, 5)
+}
+
+func TestRateLimiter_InvalidRate(t *testing.T) {
+	for _, rate := range []float64{0, -1, math.NaN()} {
+		assert.PanicsWithValue(t, "rate must be positive", func() { NewRateLimiter(rate, 1, nil) })
+	}
+}
+
+func TestChain(t *testing.T) {
+	clock := newManualClock()
+	errUnavailable := errors.New("unavailable")
+
+	var buf bytes.Buffer
+	breaker := NewCircuitBreaker(3, time.Minute, clock)
+	resilient := Chain(
+		LoggingWithClock(log.New(&buf, "", 0), "fetch", clock),
+		Recover(),
+		RetryWith(RetryPolicy{Attempts: 5, Retryable: func(err error) bool { return !errors.Is(err, ErrCircuitOpen) }}),
+		breaker.Middleware(),
+		Timeout(time.Second, clock),
+	)
+
+	var calls int
+	fetch := Decorate(func(ctx context.Context, key string) (string, error) {
+		calls++
+		return "", errUnavailable
+	}, resilient)
+
+	_, err := fetch(context.Background(), "key")
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 3, calls) // the breaker opened before the retries ran out.
+	assert.Equal(t, "fetch: failed in 0s: circuit breaker is open\n", buf.String())
+}
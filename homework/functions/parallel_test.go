@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v homework_test.go parallel_test.go
+// go test -bench=Parallel homework_test.go parallel_test.go
+
+// PanicError is a panic recovered in one of the workers.
+type PanicError struct {
+	Value any
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in worker: %v", e.Value)
+}
+
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+func workersCount(workers, n int) int {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return min(workers, n)
+}
+
+// parallelRange splits [0, n) into contiguous ranges and runs action for
+// them on at most workers goroutines. Workers pick the ranges one by one,
+// so slow ranges don't hold the others back. The first error or panic
+// cancels the remaining work and is returned.
+func parallelRange(ctx context.Context, n, workers, ranges int, action func(ctx context.Context, lo, hi int) error) error {
+	if n == 0 {
+		return ctx.Err()
+	}
+
+	workers = workersCount(workers, n)
+	size := max(1, (n+ranges-1)/ranges)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		next     atomic.Int64
+		once     sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if v := recover(); v != nil {
+					fail(&PanicError{Value: v})
+				}
+			}()
+
+			for {
+				lo := int(next.Add(int64(size))) - size
+				if lo >= n || ctx.Err() != nil {
+					return
+				}
+				if err := action(ctx, lo, min(lo+size, n)); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	// the parent context could be canceled after the last range was taken.
+	return context.Cause(ctx)
+}
+
+// ParallelMap is Map spread over at most workers goroutines (GOMAXPROCS
+// if workers <= 0). The result keeps the input order. Processing stops at
+// the first error, panic or context cancellation, which is returned
+// together with a nil slice.
+func ParallelMap[T, U any](ctx context.Context, src []T, workers int, action func(T) (U, error)) ([]U, error) {
+	if src == nil {
+		return nil, ctx.Err()
+	}
+
+	dst := make([]U, len(src))
+	err := parallelRange(ctx, len(src), workers, 4*workersCount(workers, len(src)), func(ctx context.Context, lo, hi int) error {
+		for i := lo; i < hi; i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			v, err := action(src[i])
+			if err != nil {
+				return err
+			}
+			dst[i] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// ParallelFilter is Filter with the predicate spread over at most workers
+// goroutines. The kept elements stay in the input order.
+func ParallelFilter[T any](ctx context.Context, src []T, workers int, action func(T) (bool, error)) ([]T, error) {
+	keep, err := ParallelMap(ctx, src, workers, action)
+	if err != nil || keep == nil {
+		return nil, err
+	}
+
+	var dst []T
+	for i := range src {
+		if keep[i] {
+			dst = append(dst, src[i])
+		}
+	}
+	return dst, nil
+}
+
+// ParallelReduce is Reduce spread over at most workers goroutines.
+//
+// action MUST be associative: action(action(a, b), c) == action(a, action(b, c)).
+// The input is split into contiguous parts, each part is reduced on its own
+// and the partial results are combined in the input order, so action
+// doesn't need to be commutative, but it is applied in a different
+// grouping than the sequential Reduce: a non-associative action (e.g.
+// subtraction) gives a different result. Floating point addition is only
+// approximately associative, so results may differ in the last bits.
+func ParallelReduce[T any](ctx context.Context, data []T, workers int, initial T, action func(T, T) T) (T, error) {
+	if len(data) == 0 {
+		return initial, ctx.Err()
+	}
+
+	parts := workersCount(workers, len(data))
+	size := (len(data) + parts - 1) / parts
+	partials := make([]T, (len(data)+size-1)/size)
+
+	err := parallelRange(ctx, len(data), workers, parts, func(ctx context.Context, lo, hi int) error {
+		res := data[lo]
+		for i := lo + 1; i < hi; i++ {
+			res = action(res, data[i])
+		}
+		partials[lo/size] = res
+		return ctx.Err()
+	})
+	if err != nil {
+		return initial, err
+	}
+
+	res := initial
+	for _, p := range partials {
+		res = action(res, p)
+	}
+	return res, nil
+}
+
+func TestParallelMap(t *testing.T) {
+	tests := map[string]struct {
+		data    []int
+		workers int
+		result  []string
+	}{
+		"nil numbers": {},
+		"empty numbers": {
+			data:   []int{},
+			result: []string{},
+		},
+		"default workers": {
+			data:   []int{1, 2, 3, 4, 5},
+			result: []string{"1", "2", "3", "4", "5"},
+		},
+		"more workers than numbers": {
+			data:    []int{1, 2, 3},
+			workers: 10,
+			result:  []string{"1", "2", "3"},
+		},
+		"single worker": {
+			data:    []int{3, 2, 1},
+			workers: 1,
+			result:  []string{"3", "2", "1"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := ParallelMap(context.Background(), test.data, test.workers, func(v int) (string, error) {
+				return strconv.Itoa(v), nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, test.result, result)
+		})
+	}
+}
+
+func TestParallelMap_Order(t *testing.T) {
+	data := make([]int, 1000)
+	for i := range data {
+		data[i] = i
+	}
+
+	result, err := ParallelMap(context.Background(), data, 8, func(v int) (int, error) {
+		if v%7 == 0 {
+			time.Sleep(time.Microsecond) // shuffle the completion order.
+		}
+		return v * v, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, Map(data, func(v int) int { return v * v }), result)
+}
+
+func TestParallelMap_Error(t *testing.T) {
+	errOdd := errors.New("odd number")
+	data := make([]int, 1000)
+	for i := range data {
+		data[i] = i * 2
+	}
+	data[10] = 21
+
+	var calls atomic.Int64
+	result, err := ParallelMap(context.Background(), data, 4, func(v int) (int, error) {
+		calls.Add(1)
+		if v%2 != 0 {
+			return 0, errOdd
+		}
+		time.Sleep(100 * time.Microsecond)
+		return v, nil
+	})
+	assert.ErrorIs(t, err, errOdd)
+	assert.Nil(t, result)
+	assert.Less(t, calls.Load(), int64(len(data)))
+}
+
+func TestParallelMap_Panic(t *testing.T) {
+	errBoom := errors.New("boom")
+	_, err := ParallelMap(context.Background(), []int{1, 2, 3}, 2, func(v int) (int, error) {
+		if v == 2 {
+			panic(errBoom)
+		}
+		return v, nil
+	})
+
+	var perr *PanicError
+	assert.True(t, errors.As(err, &perr))
+	assert.ErrorIs(t, err, errBoom)
+}
+
+func TestParallelMap_Context(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var calls atomic.Int64
+	_, err := ParallelMap(ctx, make([]int, 1000), 4, func(v int) (int, error) {
+		if calls.Add(1) == 10 {
+			cancel()
+		}
+		return v, nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, calls.Load(), int64(1000))
+
+	_, err = ParallelMap(ctx, []int{}, 4, func(v int) (int, error) { return v, nil })
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestParallelFilter(t *testing.T) {
+	data := []int{-1, -2, 1, 2, 3, 4, -5, 6}
+	result, err := ParallelFilter(context.Background(), data, 3, func(v int) (bool, error) {
+		return v > 0, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4, 6}, result)
+
+	result, err = ParallelFilter(context.Background(), data, 3, func(v int) (bool, error) {
+		return false, nil
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, result)
+
+	_, err = ParallelFilter(context.Background(), data, 3, func(v int) (bool, error) {
+		return false, context.DeadlineExceeded
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestParallelReduce(t *testing.T) {
+	data := make([]int, 1001)
+	for i := range data {
+		data[i] = i
+	}
+	sum := func(lhs, rhs int) int { return lhs + rhs }
+
+	for _, workers := range []int{0, 1, 3, 8, 2000} {
+		result, err := ParallelReduce(context.Background(), data, workers, 10, sum)
+		assert.NoError(t, err)
+		assert.Equal(t, Reduce(data, 10, sum), result)
+	}
+
+	// concatenation is associative but not commutative: the order must hold.
+	words := []string{"a", "b", "c", "d", "e", "f", "g"}
+	concat := func(lhs, rhs string) string { return lhs + rhs }
+	result, err := ParallelReduce(context.Background(), words, 3, ">", concat)
+	assert.NoError(t, err)
+	assert.Equal(t, ">abcdefg", result)
+
+	empty, err := ParallelReduce(context.Background(), nil, 3, 42, sum)
+	assert.NoError(t, err)
+	assert.Equal(t, 42, empty)
+
+	_, err = ParallelReduce(context.Background(), data, 3, 0, func(lhs, rhs int) int {
+		panic("overflow")
+	})
+	assert.EqualError(t, err, "panic in worker: overflow")
+}
+
+// work emulates a CPU-heavy transformation.
+func work(v int) int {
+	for i := 0; i < 200; i++ {
+		v = v*31 + i
+	}
+	return v
+}
+
+var parallelSink int
+
+// For small inputs the goroutines startup dominates and the sequential
+// Map wins. With ~200 ns of work per element ParallelMap starts to win
+// somewhere between 100 and 1k elements, the exact point depends on the
+// number of cores. With GOMAXPROCS=1 the parallel version never wins.
+func BenchmarkParallelMap(b *testing.B) {
+	for _, size := range []int{10, 100, 1_000, 10_000, 100_000} {
+		data := make([]int, size)
+		for i := range data {
+			data[i] = i
+		}
+
+		b.Run(fmt.Sprintf("sequential/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				parallelSink = len(Map(data, work))
+			}
+		})
+		b.Run(fmt.Sprintf("parallel/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				res, _ := ParallelMap(context.Background(), data, 0, func(v int) (int, error) {
+					return work(v), nil
+				})
+				parallelSink = len(res)
+			}
+		})
+	}
+}
+
+// A cheap combine step is memory bound: ParallelReduce of a sum only
+// pays off for large inputs (hundreds of thousands of elements).
+func BenchmarkParallelReduce(b *testing.B) {
+	sum := func(lhs, rhs int) int { return lhs + rhs }
+	for _, size := range []int{1_000, 100_000, 1_000_000} {
+		data := make([]int, size)
+		for i := range data {
+			data[i] = i
+		}
+
+		b.Run(fmt.Sprintf("sequential/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				parallelSink = Reduce(data, 0, sum)
+			}
+		})
+		b.Run(fmt.Sprintf("parallel/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				parallelSink, _ = ParallelReduce(context.Background(), data, 0, 0, sum)
+			}
+		})
+	}
+}
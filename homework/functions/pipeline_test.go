@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v homework_test.go parallel_test.go middleware_test.go pipeline_test.go
+
+// Stage is a pipeline step, it can change the type of the value and fail.
+type Stage[In, Out any] func(ctx context.Context, in In) (Out, error)
+
+// StageError reports the stage that stopped the pipeline.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("stage %q: %v", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// stage is a Stage with erased types: the pipeline is a list of them, the
+// types are checked when the pipeline is built by NewPipeline and Then.
+type stage struct {
+	name    string
+	workers int
+	run     func(ctx context.Context, in any) (any, error)
+}
+
+type StageOption func(s *stage)
+
+// Workers sets the number of goroutines running the stage in Stream.
+func Workers(n int) StageOption {
+	return func(s *stage) {
+		s.workers = max(1, n)
+	}
+}
+
+func newStage[In, Out any](name string, fn Stage[In, Out], opts []StageOption) stage {
+	s := stage{
+		name:    name,
+		workers: 1,
+		run: func(ctx context.Context, in any) (any, error) {
+			return fn(ctx, as[In](in))
+		},
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return s
+}
+
+// runSafe is run for the goroutines of Stream, where nobody can recover a
+// panic of the stage: it is returned as a *PanicError instead.
+func (s stage) runSafe(ctx context.Context, in any) (out any, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v}
+		}
+	}()
+	return s.run(ctx, in)
+}
+
+// as converts an erased value back, a nil interface becomes the zero value.
+func as[T any](v any) T {
+	t, _ := v.(T)
+	return t
+}
+
+// Pipeline is a chain of stages turning In into Out. A Pipeline is
+// immutable, so a common prefix can be extended in different ways.
+type Pipeline[In, Out any] struct {
+	stages []stage
+}
+
+func NewPipeline[In, Out any](name string, fn Stage[In, Out], opts ...StageOption) Pipeline[In, Out] {
+	return Pipeline[In, Out]{stages: []stage{newStage(name, fn, opts)}}
+}
+
+// Then appends a stage to the pipeline. It is a function and not a method,
+// because methods can't introduce the new type parameter Next.
+func Then[In, Out, Next any](p Pipeline[In, Out], name string, fn Stage[Out, Next], opts ...StageOption) Pipeline[In, Next] {
+	return Pipeline[In, Next]{stages: append(slices.Clip(p.stages), newStage(name, fn, opts))}
+}
+
+// Run passes in through the stages one by one. The first error stops the
+// pipeline and is returned as a *StageError.
+func (p Pipeline[In, Out]) Run(ctx context.Context, in In) (Out, error) {
+	var v any = in
+	for _, s := range p.stages {
+		if err := ctx.Err(); err != nil {
+			var zero Out
+			return zero, &StageError{Stage: s.name, Err: err}
+		}
+
+		var err error
+		if v, err = s.run(ctx, v); err != nil {
+			var zero Out
+			return zero, &StageError{Stage: s.name, Err: err}
+		}
+	}
+	return as[Out](v), nil
+}
+
+// Stream runs every stage in its own set of goroutines (see Workers)
+// connected with channels, so different values are processed by different
+// stages at the same time. With more than one worker in any stage the
+// output order may differ from the input order.
+//
+// The first error or panic cancels the whole graph, it is sent to the
+// error channel as a *StageError. The cancellation of ctx is sent as
+// the cause of ctx. The error channel is closed once all the goroutines
+// have exited. The caller must either drain the output channel or cancel
+// ctx, otherwise the goroutines leak.
+func (p Pipeline[In, Out]) Stream(ctx context.Context, src <-chan In) (<-chan Out, <-chan error) {
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+		errc = make(chan error, 1)
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			errc <- err
+			cancel()
+		})
+	}
+
+	in := make(chan any)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(in)
+		for {
+			select {
+			case v, ok := <-src:
+				if !ok {
+					return
+				}
+				select {
+				case in <- v:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var prev <-chan any = in
+	for _, s := range p.stages {
+		next := make(chan any)
+
+		var stageWg sync.WaitGroup
+		stageWg.Add(s.workers)
+		for w := 0; w < s.workers; w++ {
+			wg.Add(1)
+			go func(in <-chan any) {
+				defer wg.Done()
+				defer stageWg.Done()
+				for v := range in {
+					res, err := s.runSafe(ctx, v)
+					if err != nil {
+						fail(&StageError{Stage: s.name, Err: err})
+						return
+					}
+					select {
+					case next <- res:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}(prev)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stageWg.Wait()
+			close(next)
+		}()
+		prev = next
+	}
+
+	out := make(chan Out)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(out)
+		for v := range prev {
+			select {
+			case out <- as[Out](v):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		if err := context.Cause(parent); err != nil {
+			fail(err)
+		}
+		cancel()
+		close(errc)
+	}()
+	return out, errc
+}
+
+var errNegative = errors.New("negative number")
+
+func parse(ctx context.Context, s string) (int, error) {
+	return strconv.Atoi(s)
+}
+
+func sqrt(ctx context.Context, v int) (float64, error) {
+	if v < 0 {
+		return 0, errNegative
+	}
+	x := float64(v)
+	for i := 0; i < 20; i++ {
+		x = (x + float64(v)/x) / 2
+	}
+	return x, nil
+}
+
+func format(ctx context.Context, v float64) (string, error) {
+	return strconv.FormatFloat(v, 'f', 2, 64), nil
+}
+
+func TestPipeline_Run(t *testing.T) {
+	p := Then(Then(NewPipeline("parse", parse), "sqrt", sqrt), "format", format)
+
+	result, err := p.Run(context.Background(), "16")
+	assert.NoError(t, err)
+	assert.Equal(t, "4.00", result)
+
+	_, err = p.Run(context.Background(), "x")
+	var serr *StageError
+	assert.True(t, errors.As(err, &serr))
+	assert.Equal(t, "parse", serr.Stage)
+	assert.ErrorIs(t, err, strconv.ErrSyntax)
+
+	_, err = p.Run(context.Background(), "-4")
+	assert.ErrorIs(t, err, errNegative)
+	assert.EqualError(t, err, `stage "sqrt": negative number`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = p.Run(ctx, "16")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestPipeline_Immutable(t *testing.T) {
+	base := Then(NewPipeline("parse", parse), "sqrt", sqrt)
+	formatted := Then(base, "format", format)
+	rounded := Then(base, "round", func(ctx context.Context, v float64) (int, error) {
+		return int(v + 0.5), nil
+	})
+
+	s, err := formatted.Run(context.Background(), "2")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.41", s)
+
+	i, err := rounded.Run(context.Background(), "2")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, i)
+
+	// the types are erased inside: interface results must survive as well.
+	errs := Then(NewPipeline("parse", parse), "check", func(ctx context.Context, v int) (error, error) {
+		if v == 0 {
+			return nil, nil
+		}
+		return errNegative, nil
+	})
+	e, err := errs.Run(context.Background(), "0")
+	assert.NoError(t, err)
+	assert.Nil(t, e)
+}
+
+func TestPipeline_Decorated(t *testing.T) {
+	errTemporary := errors.New("temporary error")
+
+	var calls int
+	flaky := func(ctx context.Context, v int) (int, error) {
+		if calls++; calls%2 == 1 {
+			return 0, errTemporary
+		}
+		return v * 2, nil
+	}
+
+	var timings int
+	p := Then(NewPipeline("parse", parse), "double", Decorate(flaky,
+		Timing(func(d time.Duration, err error) { timings++ }),
+		Retry(2, 0),
+	))
+
+	result, err := p.Run(context.Background(), "21")
+	assert.NoError(t, err)
+	assert.Equal(t, 42, result)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 1, timings)
+}
+
+func generate[T any](values ...T) <-chan T {
+	ch := make(chan T)
+	go func() {
+		defer close(ch)
+		for _, v := range values {
+			ch <- v
+		}
+	}()
+	return ch
+}
+
+func TestPipeline_Stream(t *testing.T) {
+	var inflight, peak atomic.Int64
+	slowSqrt := func(ctx context.Context, v int) (float64, error) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(5 * time.Millisecond)
+		return sqrt(ctx, v)
+	}
+
+	p := Then(Then(NewPipeline("parse", parse), "sqrt", slowSqrt, Workers(4)), "format", format)
+
+	out, errc := p.Stream(context.Background(), generate("1", "4", "9", "16", "25", "36", "49", "64"))
+
+	var results []string
+	for v := range out {
+		results = append(results, v)
+	}
+	assert.NoError(t, <-errc)
+
+	sort.Slice(results, func(i, j int) bool {
+		lhs, _ := strconv.ParseFloat(results[i], 64)
+		rhs, _ := strconv.ParseFloat(results[j], 64)
+		return lhs < rhs
+	})
+	assert.Equal(t, []string{"1.00", "2.00", "3.00", "4.00", "5.00", "6.00", "7.00", "8.00"}, results)
+	assert.Greater(t, peak.Load(), int64(1))
+}
+
+func TestPipeline_StreamError(t *testing.T) {
+	p := Then(NewPipeline("parse", parse, Workers(2)), "sqrt", sqrt, Workers(2))
+
+	src := make(chan string)
+	go func() {
+		defer close(src)
+		for i := 0; ; i++ {
+			v := strconv.Itoa(i)
+			if i == 5 {
+				v = "-1"
+			}
+			select {
+			case src <- v:
+			case <-time.After(time.Second):
+				return // the pipeline has stopped reading.
+			}
+		}
+	}()
+
+	out, errc := p.Stream(context.Background(), src)
+	for range out {
+	}
+
+	err := <-errc
+	assert.ErrorIs(t, err, errNegative)
+	_, ok := <-errc
+	assert.False(t, ok)
+}
+
+func TestPipeline_StreamCancel(t *testing.T) {
+	p := NewPipeline("parse", parse)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	src := make(chan string) // never sends.
+	out, errc := p.Stream(ctx, src)
+	for range out {
+	}
+	assert.ErrorIs(t, <-errc, context.DeadlineExceeded)
+}
+
+func TestPipeline_StreamParentCancel(t *testing.T) {
+	p := NewPipeline("parse", parse)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	src := make(chan string)
+	out, errc := p.Stream(ctx, src)
+
+	src <- "1"
+	assert.Equal(t, 1, <-out)
+	cancel()
+	for range out {
+	}
+	assert.ErrorIs(t, <-errc, context.Canceled)
+	_, ok := <-errc
+	assert.False(t, ok)
+}
+
+func TestPipeline_StreamPanic(t *testing.T) {
+	p := Then(NewPipeline("parse", parse), "invert", func(ctx context.Context, v int) (int, error) {
+		return 100 / v, nil
+	}, Workers(2))
+
+	out, errc := p.Stream(context.Background(), generate("1", "2", "4", "0"))
+	for range out {
+	}
+
+	err := <-errc
+	var serr *StageError
+	assert.True(t, errors.As(err, &serr))
+	assert.Equal(t, "invert", serr.Stage)
+	var perr *PanicError
+	assert.True(t, errors.As(err, &perr))
+	assert.ErrorContains(t, err, "integer divide by zero")
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v -run 'Clone' .
+
+const (
+	cloneTag          = "clone"
+	cloneTokenSkip    = "-"
+	cloneTokenShallow = "shallow"
+)
+
+// Clone returns a deep copy of v: the structs, pointers, slices, maps,
+// arrays and interfaces are copied recursively. A pointer, a map or a
+// slice met twice is copied once, so the cycles and the shared references
+// of v are the same in the copy.
+//
+// The rest follows the assignment:
+//   - the channels, funcs and unsafe pointers are shared with v;
+//   - the unexported fields are copied shallowly, as the reflection can't
+//     set them, so time.Time and the like are copied as they should;
+//   - the fields tagged `clone:"-"` are left zero, and the ones tagged
+//     `clone:"shallow"` are shared with v.
+//
+// The slices are shared only if they have the same start, length and type,
+// and a pointer into a value is not linked with the copy of the value.
+// Clone panics on an invalid clone tag.
+func Clone[T any](v T) T {
+	src := reflect.ValueOf(&v).Elem()
+	dst := reflect.New(src.Type()).Elem()
+
+	c := cloner{visited: make(map[visitKey]reflect.Value)}
+	c.clone(dst, src)
+	return *dst.Addr().Interface().(*T)
+}
+
+type visitKey struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+type cloner struct {
+	visited map[visitKey]reflect.Value
+}
+
+// clone copies src to dst, a settable value of the same type.
+func (c *cloner) clone(dst, src reflect.Value) {
+	switch src.Kind() {
+	case reflect.Ptr:
+		if src.IsNil() {
+			return
+		}
+		c.share(dst, visitKey{ptr: src.Pointer(), typ: src.Type()}, func() reflect.Value {
+			return reflect.New(src.Type().Elem())
+		}, func(v reflect.Value) {
+			c.clone(v.Elem(), src.Elem())
+		})
+
+	case reflect.Map:
+		if src.IsNil() {
+			return
+		}
+		c.share(dst, visitKey{ptr: src.Pointer(), typ: src.Type()}, func() reflect.Value {
+			return reflect.MakeMapWithSize(src.Type(), src.Len())
+		}, func(m reflect.Value) {
+			t := src.Type()
+			for iter := src.MapRange(); iter.Next(); {
+				k, v := reflect.New(t.Key()).Elem(), reflect.New(t.Elem()).Elem()
+				c.clone(k, iter.Key())
+				c.clone(v, iter.Value())
+				m.SetMapIndex(k, v)
+			}
+		})
+
+	case reflect.Slice:
+		if src.IsNil() {
+			return
+		}
+		c.share(dst, visitKey{ptr: src.Pointer(), typ: src.Type(), len: src.Len()}, func() reflect.Value {
+			return reflect.MakeSlice(src.Type(), src.Len(), src.Cap())
+		}, func(s reflect.Value) {
+			for i := 0; i < src.Len(); i++ {
+				c.clone(s.Index(i), src.Index(i))
+			}
+		})
+
+	case reflect.Array:
+		for i := 0; i < src.Len(); i++ {
+			c.clone(dst.Index(i), src.Index(i))
+		}
+
+	case reflect.Interface:
+		if src.IsNil() {
+			return
+		}
+		v := reflect.New(src.Elem().Type()).Elem()
+		c.clone(v, src.Elem())
+		dst.Set(v)
+
+	case reflect.Struct:
+		dst.Set(src) // the unexported fields.
+		for _, f := range cloneFieldsOf(src.Type()) {
+			switch f.mode {
+			case cloneSkip:
+				dst.Field(f.index).SetZero()
+			case cloneDeep:
+				c.clone(dst.Field(f.index), src.Field(f.index))
+			}
+		}
+
+	default:
+		dst.Set(src)
+	}
+}
+
+// share sets dst to the copy made for key, or to a new one made by alloc
+// and filled by fill. The copy is visited before it's filled, so the cycles
+// end on it.
+func (c *cloner) share(dst reflect.Value, key visitKey, alloc func() reflect.Value, fill func(reflect.Value)) {
+	if v, ok := c.visited[key]; ok {
+		dst.Set(v)
+		return
+	}
+
+	v := alloc()
+	c.visited[key] = v
+	fill(v)
+	dst.Set(v)
+}
+
+type cloneMode int
+
+const (
+	cloneDeep cloneMode = iota
+	cloneShallow
+	cloneSkip
+)
+
+type cloneField struct {
+	index int
+	mode  cloneMode
+}
+
+var clonePlans sync.Map // reflect.Type -> []cloneField
+
+// cloneFieldsOf returns the exported fields of t that aren't copied by the
+// assignment of the struct.
+func cloneFieldsOf(t reflect.Type) []cloneField {
+	if fields, ok := clonePlans.Load(t); ok {
+		return fields.([]cloneField)
+	}
+
+	var fields []cloneField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		var mode cloneMode
+		switch tag := f.Tag.Get(cloneTag); tag {
+		case "":
+			mode = cloneDeep
+		case cloneTokenShallow:
+			mode = cloneShallow
+		case cloneTokenSkip:
+			mode = cloneSkip
+		default:
+			panic(fmt.Errorf("field %s.%s: %w: %s", t, f.Name, ErrInvalidToken, tag))
+		}
+		if mode != cloneShallow {
+			fields = append(fields, cloneField{index: i, mode: mode})
+		}
+	}
+
+	actual, _ := clonePlans.LoadOrStore(t, fields)
+	return actual.([]cloneField)
+}
+
+type (
+	GraphNode struct {
+		Name  string
+		Edges []*GraphNode
+		Attrs map[string]any
+	}
+
+	Session struct {
+		ID      string
+		User    *Person
+		Owner   *Person // usually the same as User.
+		Created time.Time
+		Roles   [2]string
+		Data    any
+		Cache   map[string][]byte `clone:"-"`
+		Logger  *Buffer           `clone:"shallow"`
+		Done    chan struct{}
+		OnClose func() string
+		secret  *string
+	}
+
+	Buffer struct {
+		Lines []string
+	}
+)
+
+func TestClone(t *testing.T) {
+	user := &Person{Name: "john", Address: "home", Age: 30}
+	secret := "token"
+	in := Session{
+		ID:      "s-1",
+		User:    user,
+		Owner:   user,
+		Created: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		Roles:   [2]string{"admin", "user"},
+		Data:    map[string][]int{"ids": {1, 2}},
+		Cache:   map[string][]byte{"k": []byte("v")},
+		Logger:  &Buffer{},
+		Done:    make(chan struct{}),
+		OnClose: func() string { return "closed" },
+		secret:  &secret,
+	}
+
+	out := Clone(in)
+	assert.Equal(t, in.ID, out.ID)
+	assert.Equal(t, *in.User, *out.User)
+	assert.NotSame(t, in.User, out.User)
+	assert.Same(t, out.User, out.Owner, "shared references stay shared")
+	assert.Equal(t, in.Created, out.Created)
+	assert.Equal(t, in.Roles, out.Roles)
+	assert.Equal(t, in.Data, out.Data)
+	assert.Nil(t, out.Cache, "clone:\"-\" is skipped")
+	assert.Same(t, in.Logger, out.Logger, "clone:\"shallow\" is shared")
+	assert.Equal(t, in.Done, out.Done, "channels are shared")
+	assert.Equal(t, "closed", out.OnClose(), "funcs are shared")
+	assert.Same(t, in.secret, out.secret, "unexported fields are copied shallowly")
+
+	out.User.Name = "jane"
+	out.Roles[0] = "guest"
+	out.Data.(map[string][]int)["ids"][0] = 100
+	assert.Equal(t, "john", in.User.Name)
+	assert.Equal(t, "admin", in.Roles[0])
+	assert.Equal(t, []int{1, 2}, in.Data.(map[string][]int)["ids"])
+}
+
+func TestClone_Cycles(t *testing.T) {
+	a := &GraphNode{Name: "a", Attrs: map[string]any{}}
+	b := &GraphNode{Name: "b"}
+	c := &GraphNode{Name: "c"}
+	a.Edges = []*GraphNode{b, c}
+	b.Edges = []*GraphNode{c, a}
+	c.Edges = []*GraphNode{c} // a self loop.
+	a.Attrs["self"] = a.Attrs // a map containing itself.
+	a.Attrs["edges"] = a.Edges
+
+	out := Clone(a)
+	assert.NotSame(t, a, out)
+	assert.Equal(t, "a", out.Name)
+
+	ob, oc := out.Edges[0], out.Edges[1]
+	assert.NotSame(t, b, ob)
+	assert.NotSame(t, c, oc)
+	assert.Equal(t, "b", ob.Name)
+	assert.Equal(t, "c", oc.Name)
+	assert.Same(t, oc, ob.Edges[0])
+	assert.Same(t, out, ob.Edges[1])
+	assert.Same(t, oc, oc.Edges[0])
+
+	attrs := out.Attrs["self"].(map[string]any)
+	assert.Equal(t, reflect.ValueOf(out.Attrs).Pointer(), reflect.ValueOf(attrs).Pointer())
+	assert.NotEqual(t, reflect.ValueOf(a.Attrs).Pointer(), reflect.ValueOf(attrs).Pointer())
+
+	edges := out.Attrs["edges"].([]*GraphNode)
+	assert.Equal(t, reflect.ValueOf(out.Edges).Pointer(), reflect.ValueOf(edges).Pointer(), "the same slice is copied once")
+
+	out.Edges[0].Name = "changed"
+	assert.Equal(t, "b", b.Name)
+}
+
+func TestClone_Values(t *testing.T) {
+	assert.Equal(t, 42, Clone(42))
+	assert.Equal(t, "text", Clone("text"))
+	assert.Nil(t, Clone[*Person](nil))
+	assert.Nil(t, Clone[[]int](nil))
+	assert.Nil(t, Clone[map[string]int](nil))
+	assert.Nil(t, Clone[any](nil))
+	assert.Nil(t, Clone[error](nil))
+
+	in := []int{1, 2, 3}
+	out := Clone(in[:2])
+	assert.Equal(t, []int{1, 2}, out)
+	assert.Equal(t, 3, cap(out))
+	out[0] = 100
+	assert.Equal(t, 1, in[0])
+
+	var iface fmt.Stringer = time.Second
+	assert.Equal(t, time.Second, Clone(iface))
+
+	p := &Person{Name: "john"}
+	pp := Clone(&p)
+	assert.NotSame(t, p, *pp)
+	assert.Equal(t, *p, **pp)
+
+	assert.PanicsWithError(t, "field struct { Name string \"clone:\\\"deep\\\"\" }.Name: invalid token: deep", func() {
+		Clone(struct {
+			Name string `clone:"deep"`
+		}{})
+	})
+}
+
+func BenchmarkClone(b *testing.B) {
+	in := benchConfig
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Clone(in)
+	}
+}
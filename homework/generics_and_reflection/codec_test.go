@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v -run 'Escape|Props|Encoder|Decoder' .
+
+// The format is the one of java.util.Properties:
+//
+//   - the lines are separated by \n, \r\n or \r;
+//   - blank lines and the lines starting with # or ! are skipped;
+//   - a line ending with an odd number of backslashes continues on the next
+//     one, whose leading whitespace is skipped;
+//   - the key ends at the first unescaped '=', ':' or whitespace, the
+//     whitespace around the separator is skipped, a line without a
+//     separator is a key with an empty value;
+//   - \t, \n, \r, \f and \uXXXX (UTF-16, surrogate pairs included) are
+//     escapes, any other escaped character stands for itself, e.g. "\ " is
+//     a space that isn't skipped and "\=" is a '=' in a key.
+//
+// The elements of the lists are separated by commas, a comma inside an
+// element is escaped as "\,": Java readers see the whole list as a string.
+//
+// A stream of several documents, see Encoder, ends every document with the
+// comment line "#---", so Java readers see the rows of all of them.
+
+var ErrInvalidEscape = errors.New("invalid unicode escape")
+
+const (
+	propsWhitespace = " \t\f"
+	propsComments   = "#!"
+	propsKeyEnd     = "=: \t\f"
+	propsDocSep     = "#---"
+
+	// maxLineSize limits a single line of the input, see bufio.Scanner.
+	maxLineSize = 1 << 20
+)
+
+// escape escapes the backslashes, the control characters and the specials.
+func escape(s, specials string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\f':
+			b.WriteString(`\f`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		case strings.ContainsRune(specials, r):
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// escapeKey escapes the key, the comment characters are escaped as Java
+// does to keep the keys readable for it even at the start of the line.
+func escapeKey(s string) string {
+	return escape(s, propsKeyEnd+propsComments)
+}
+
+func escapeValue(s string) string {
+	return escapeLeading(escape(s, ""))
+}
+
+// escapeLeading escapes the leading space of an escaped value, which would
+// be skipped otherwise. The other whitespace is escaped already.
+func escapeLeading(s string) string {
+	if strings.HasPrefix(s, " ") {
+		return `\` + s
+	}
+	return s
+}
+
+// escapeASCII replaces the non-ASCII characters with \uXXXX escapes.
+func escapeASCII(data []byte) []byte {
+	var out []byte
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r < utf8.RuneSelf {
+			out = append(out, data[0])
+		} else {
+			for _, u := range utf16.Encode([]rune{r}) {
+				out = fmt.Appendf(out, `\u%04x`, u)
+			}
+		}
+		data = data[size:]
+	}
+	return out
+}
+
+// unescape is the reverse of escape. A trailing single backslash is
+// dropped.
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	var b strings.Builder
+	var units []uint16 // a pending UTF-16 sequence.
+	flush := func() {
+		b.WriteString(string(utf16.Decode(units)))
+		units = units[:0]
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			if s[i] != '\\' {
+				flush()
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+
+		i++
+		if s[i] == 'u' {
+			if i+5 > len(s) {
+				return "", fmt.Errorf("%w %q", ErrInvalidEscape, s[i-1:])
+			}
+			u, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+			if err != nil {
+				return "", fmt.Errorf("%w %q", ErrInvalidEscape, s[i-1:i+5])
+			}
+			units = append(units, uint16(u))
+			i += 4
+			continue
+		}
+
+		flush()
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	flush()
+	return b.String(), nil
+}
+
+// splitList splits the escaped value on the unescaped commas.
+func splitList(raw string) []string {
+	var elms []string
+	start := 0
+	for i := 0; i < len(raw); i++ {
+		switch raw[i] {
+		case '\\':
+			i++
+		case propsElemsSep[0]:
+			elms = append(elms, raw[start:i])
+			start = i + 1
+		}
+	}
+	return append(elms, raw[start:])
+}
+
+// scanLines is bufio.ScanLines that accepts a single \r as well.
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	i := bytes.IndexAny(data, "\r\n")
+	switch {
+	case i < 0 && atEOF && len(data) > 0:
+		return len(data), data, nil
+	case i < 0:
+		return 0, nil, nil
+	case data[i] == '\n':
+		return i + 1, data[:i], nil
+	case i+1 < len(data):
+		if data[i+1] == '\n' {
+			return i + 2, data[:i], nil
+		}
+		return i + 1, data[:i], nil
+	case atEOF:
+		return i + 1, data[:i], nil
+	}
+	return 0, nil, nil // is the \r followed by \n?
+}
+
+// continues reports whether the line ends with an odd number of backslashes.
+func continues(line string) bool {
+	n := len(line) - len(strings.TrimRight(line, `\`))
+	return n%2 == 1
+}
+
+// readProps reads all the rows from r, see the format above. The document
+// separators are comments for it.
+func readProps(r io.Reader) (props, error) {
+	p, err := newPropsReader(r).read(false)
+	if err == io.EOF {
+		return make(props), nil
+	}
+	return p, err
+}
+
+// propsReader reads the rows of the documents one by one.
+type propsReader struct {
+	sc     *bufio.Scanner
+	lineno int
+}
+
+func newPropsReader(r io.Reader) *propsReader {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxLineSize)
+	sc.Split(scanLines)
+	return &propsReader{sc: sc}
+}
+
+// read reads the rows up to the end of the stream or, if split is set, up
+// to the next document separator. It returns io.EOF if the stream has
+// ended before the call.
+func (pr *propsReader) read(split bool) (props, error) {
+	sc := pr.sc
+
+	p := make(props)
+	var logical strings.Builder
+	var start int
+	var continuing bool
+	empty := true
+
+	for sc.Scan() {
+		pr.lineno++
+		empty = false
+		line := strings.TrimLeft(sc.Text(), propsWhitespace)
+		if !continuing {
+			if split && line == propsDocSep {
+				return p, nil
+			}
+			if line == "" || strings.ContainsRune(propsComments, rune(line[0])) {
+				continue
+			}
+			start = pr.lineno
+		}
+
+		if continuing = continues(line); continuing {
+			logical.WriteString(line[:len(line)-1])
+			continue
+		}
+		logical.WriteString(line)
+
+		if err := p.add(logical.String(), start); err != nil {
+			return nil, err
+		}
+		logical.Reset()
+	}
+	if err := sc.Err(); err != nil {
+		return nil, &ParseError{Line: pr.lineno + 1, Err: err}
+	}
+	if empty {
+		return nil, io.EOF
+	}
+
+	if continuing { // the last line ends with a backslash.
+		if err := p.add(logical.String(), start); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// add parses the logical line into a row.
+func (p props) add(line string, lineno int) error {
+	end := len(line)
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+		} else if strings.IndexByte(propsKeyEnd, line[i]) >= 0 {
+			end = i
+			break
+		}
+	}
+
+	raw := strings.TrimLeft(line[end:], propsWhitespace)
+	if raw != "" && (raw[0] == '=' || raw[0] == ':') {
+		raw = strings.TrimLeft(raw[1:], propsWhitespace)
+	}
+
+	key, err := unescape(line[:end])
+	if err != nil {
+		return &ParseError{Line: lineno, Err: err}
+	}
+	value, err := unescape(raw)
+	if err != nil {
+		return &ParseError{Line: lineno, Key: key, Err: err}
+	}
+
+	p[key] = prop{raw: raw, value: value, line: lineno}
+	return nil
+}
+
+// Encoder writes the structs to a stream, one document per struct.
+type Encoder struct {
+	w     io.Writer
+	ascii bool
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// SetASCII makes the encoder write the non-ASCII characters as \uXXXX
+// escapes, for the readers expecting ISO 8859-1, like
+// java.util.Properties.load(InputStream).
+func (e *Encoder) SetASCII(ascii bool) {
+	e.ascii = ascii
+}
+
+// Encode writes the rows of v, see Marshal, followed by the document
+// separator.
+func (e *Encoder) Encode(v any) error {
+	data, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if e.ascii {
+		data = escapeASCII(data)
+	}
+	if len(data) > 0 {
+		data = append(data, propsRowSep)
+	}
+	_, err = e.w.Write(append(data, propsDocSep+"\n"...))
+	return err
+}
+
+// Decoder reads the documents from a stream into the structs.
+type Decoder struct {
+	r *propsReader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: newPropsReader(r)}
+}
+
+// Decode reads the next document, up to the document separator or the end
+// of the stream, and stores its rows into v, see Unmarshal. It returns
+// io.EOF when there are no more documents. The line numbers of the errors
+// count from the start of the stream.
+func (d *Decoder) Decode(v any) error {
+	rv, err := target(v)
+	if err != nil {
+		return err
+	}
+
+	p, err := d.r.read(true)
+	if err != nil {
+		return err
+	}
+	return unmarshal(p, "", rv)
+}
+
+func TestEscape(t *testing.T) {
+	tests := map[string]struct {
+		in, key, value string
+	}{
+		"plain":      {in: "value", key: "value", value: "value"},
+		"separators": {in: "a=b:c d", key: `a\=b\:c\ d`, value: "a=b:c d"},
+		"comments":   {in: "#!", key: `\#\!`, value: "#!"},
+		"leading":    {in: "  two", key: `\ \ two`, value: `\  two`},
+		"controls":   {in: "a\tb\nc\r\f\x00", key: `a\tb\nc\r\f\u0000`, value: `a\tb\nc\r\f\u0000`},
+		"backslash":  {in: `C:\dir\`, key: `C\:\\dir\\`, value: `C:\\dir\\`},
+		"unicode":    {in: "Привет 😀", key: `Привет\ 😀`, value: "Привет 😀"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.key, escapeKey(test.in))
+			assert.Equal(t, test.value, escapeValue(test.in))
+
+			for _, escaped := range []string{test.key, test.value, string(escapeASCII([]byte(test.value)))} {
+				s, err := unescape(escaped)
+				assert.NoError(t, err)
+				assert.Equal(t, test.in, s)
+			}
+		})
+	}
+
+	assert.Equal(t, `\u041f\u0440\u0438 \ud83d\ude00`, string(escapeASCII([]byte("При 😀"))))
+
+	s, err := unescape(`\a\u0041\u00e9\ud83d\ude00\`)
+	assert.NoError(t, err)
+	assert.Equal(t, "aAé😀", s)
+
+	_, err = unescape(`\u12`)
+	assert.ErrorIs(t, err, ErrInvalidEscape)
+	_, err = unescape(`\uXYZW`)
+	assert.EqualError(t, err, `invalid unicode escape "\\uXYZW"`)
+}
+
+func TestReadProps(t *testing.T) {
+	data := "# comment\r\n" +
+		"  ! another comment\r" +
+		"\r\n" +
+		"plain=value\n" +
+		"colon: value\n" +
+		"space value\n" +
+		"  spaces   =   value with spaces  \n" +
+		"empty\n" +
+		"escaped\\ key\\=x = \\ leading\n" +
+		"multi = first, \\\n" +
+		"        second, \\\n" +
+		"        # not a comment\n" +
+		"even = backslash\\\\\n" +
+		"unicode = \\u00e9t\\u00e9\n" +
+		"tabs=a\\tb\n" +
+		"last = \\"
+
+	p, err := readProps(strings.NewReader(data))
+	assert.NoError(t, err)
+
+	values := make(map[string]string)
+	lines := make(map[string]int)
+	for k, v := range p {
+		values[k] = v.value
+		lines[k] = v.line
+	}
+	assert.Equal(t, map[string]string{
+		"plain":         "value",
+		"colon":         "value",
+		"space":         "value",
+		"spaces":        "value with spaces  ",
+		"empty":         "",
+		"escaped key=x": " leading",
+		"multi":         "first, second, # not a comment",
+		"even":          `backslash\`,
+		"unicode":       "été",
+		"tabs":          "a\tb",
+		"last":          "",
+	}, values)
+	assert.Equal(t, map[string]int{
+		"plain": 4, "colon": 5, "space": 6, "spaces": 7, "empty": 8, "escaped key=x": 9,
+		"multi": 10, "even": 13, "unicode": 14, "tabs": 15, "last": 16,
+	}, lines)
+
+	assert.Equal(t, []string{"a", `b\,c`, `d\\`, ""}, splitList(`a,b\,c,d\\,`))
+}
+
+func TestMarshal_Escaping(t *testing.T) {
+	type Entry struct {
+		Value string            `properties:"value"`
+		List  []string          `properties:"list"`
+		Map   map[string]string `properties:"map"`
+	}
+
+	in := Entry{
+		Value: " multi\nline = value\\",
+		List:  []string{" a,b", "", `c\`},
+		Map:   map[string]string{"key with = and :": "#value"},
+	}
+	data, err := Marshal(in)
+	assert.NoError(t, err)
+	assert.Equal(t, `value=\ multi\nline = value\\`+"\n"+
+		`list=\ a\,b,,c\\`+"\n"+
+		`map.key\ with\ \=\ and\ \:=#value`, string(data))
+
+	var out Entry
+	assert.NoError(t, Unmarshal(data, &out))
+	assert.Equal(t, in, out)
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	in := []Person{
+		{Name: "Jöhn Doe", Age: 30},
+		{Name: "Jane Doe", Address: "Paris", Married: true},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	assert.NoError(t, enc.Encode(in[0]))
+	enc.SetASCII(true)
+	assert.NoError(t, enc.Encode(&in[0]))
+	assert.ErrorIs(t, enc.Encode(42), ErrNotAStruct)
+	assert.Equal(t, "name=Jöhn Doe\nage=30\nmarried=false\n#---\n"+
+		`name=J\u00f6hn Doe`+"\nage=30\nmarried=false\n#---\n", buf.String())
+
+	buf.Reset()
+	enc = NewEncoder(&buf)
+	for _, p := range in {
+		assert.NoError(t, enc.Encode(p))
+	}
+	assert.NoError(t, enc.Encode(struct{}{}))
+
+	dec := NewDecoder(&buf)
+	for _, p := range in {
+		var out Person
+		assert.NoError(t, dec.Decode(&out))
+		assert.Equal(t, p, out)
+	}
+	var empty struct{}
+	assert.NoError(t, dec.Decode(&empty))
+	assert.Equal(t, io.EOF, dec.Decode(&empty))
+
+	// the last document doesn't need a separator, Unmarshal reads them all.
+	data := "name=John\n#---\n\n# Jane\nname=Jane\n"
+	dec = NewDecoder(strings.NewReader(data))
+	var john, jane Person
+	assert.NoError(t, dec.Decode(&john))
+	assert.NoError(t, dec.Decode(&jane))
+	assert.Equal(t, io.EOF, dec.Decode(&jane))
+	assert.Equal(t, "John", john.Name)
+	assert.Equal(t, "Jane", jane.Name)
+
+	var all Person
+	assert.NoError(t, Unmarshal([]byte(data), &all))
+	assert.Equal(t, "Jane", all.Name)
+}
+
+func TestDecoder_Errors(t *testing.T) {
+	errBroken := errors.New("broken pipe")
+	r := io.MultiReader(strings.NewReader("name=John\nage=30\n"), iotest.ErrReader(errBroken))
+
+	var p Person
+	err := NewDecoder(r).Decode(&p)
+	assert.ErrorIs(t, err, errBroken)
+	assert.EqualError(t, err, "line 3: broken pipe")
+
+	err = NewDecoder(strings.NewReader("name=John\nage=\\\n  thirty")).Decode(&p)
+	assert.EqualError(t, err, `line 2: age: strconv.ParseInt: parsing "thirty": invalid syntax`)
+
+	dec := NewDecoder(strings.NewReader("name=John\n#---\nage=x\n"))
+	assert.NoError(t, dec.Decode(&p))
+	assert.EqualError(t, dec.Decode(&p), `line 3: age: strconv.ParseInt: parsing "x": invalid syntax`)
+
+	long := "name=" + strings.Repeat("x", maxLineSize)
+	assert.ErrorIs(t, NewDecoder(strings.NewReader(long)).Decode(&p), bufio.ErrTooLong)
+
+	assert.ErrorIs(t, NewDecoder(strings.NewReader("")).Decode(p), ErrNotAPointer)
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v -run 'Load' .
+
+var ErrRequired = errors.New("required")
+
+type SourceKind string
+
+const (
+	SourceDefault SourceKind = "default"
+	SourceFile    SourceKind = "file"
+	SourceEnv     SourceKind = "env"
+	SourceFlag    SourceKind = "flag"
+)
+
+// Source tells where a value comes from.
+type Source struct {
+	Kind     SourceKind
+	Location string // the file and the line, the variable or the flag.
+}
+
+func (s Source) String() string {
+	if s.Location == "" {
+		return string(s.Kind)
+	}
+	return string(s.Kind) + " " + s.Location
+}
+
+// Sources maps the property names to the sources of their values.
+type Sources map[string]Source
+
+// lookup returns the source of the name, of the closest parent, e.g. the
+// list of an element, or of the first nested name, e.g. a row of a struct.
+func (s Sources) lookup(name string) (Source, bool) {
+	for n := name; ; n = n[:strings.LastIndex(n, propsNameSep)] {
+		if src, ok := s[n]; ok {
+			return src, true
+		}
+		if !strings.Contains(n, propsNameSep) {
+			break
+		}
+	}
+
+	first := ""
+	for k := range s {
+		if _, ok := nested(k, name); ok && (first == "" || k < first) {
+			first = k
+		}
+	}
+	src, ok := s[first]
+	return src, ok
+}
+
+// FieldError reports a required field without a value.
+type FieldError struct {
+	Field string // the Go path, e.g. Server.Port.
+	Name  string // the property name, e.g. server.port.
+	Env   string
+	Flag  string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: property %s is %v (env %s, flag -%s)", e.Field, e.Name, e.Err, e.Env, e.Flag)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Loader fills a struct from layered sources, every one overriding the
+// previous ones: the default= tag options, the properties file, the
+// environment variables and the command-line flags.
+//
+// A struct behind a pointer stays nil unless one of the sources has a row
+// for it: its defaults are applied and its required fields are checked
+// only then.
+//
+// The variables and the flags are bound to the scalar and list fields,
+// nested structs included, but not to the maps and the indexed slices,
+// whose names are unknown upfront. The property server.maxConns is the
+// PREFIX_SERVER_MAX_CONNS variable and the -server.maxConns flag. The
+// optional usage tag is the help of the flag.
+type Loader struct {
+	File      string   // the properties file, none if empty.
+	EnvPrefix string   // e.g. APP for APP_SERVER_PORT.
+	Env       []string // KEY=value pairs, os.Environ() if nil and EnvPrefix is set.
+	Args      []string // the command-line arguments without the program name, no flags if nil.
+	Output    io.Writer
+
+	Rest []string // set by Load: the arguments left after the flags.
+}
+
+// binding is a field that can be set from the environment and the flags.
+type binding struct {
+	name  string // the property name.
+	field string // the Go path.
+	typ   reflect.Type
+	plan  fieldPlan
+	leaf  bool
+
+	// optional is the property name of the closest struct behind a
+	// pointer containing the field, empty if there is none.
+	optional string
+}
+
+// present reports whether the field is reachable with the rows of p: the
+// struct behind a pointer is only allocated for its rows.
+func (b binding) present(p props) bool {
+	return b.optional == "" || p.has(b.optional)
+}
+
+// Load fills v, a pointer to a struct, and returns the sources of the
+// values. The fields marked required must have a value in one of the
+// sources, otherwise the *FieldError for every one of them are returned
+// joined.
+func (l *Loader) Load(v any) (Sources, error) {
+	rv, err := target(v)
+	if err != nil {
+		return nil, err
+	}
+
+	bindings, err := bindingsOf(rv.Type(), "", "", "", map[reflect.Type]bool{})
+	if err != nil {
+		return nil, err
+	}
+
+	p, sources := make(props), make(Sources)
+	set := func(name, raw string, src Source) error {
+		value, err := unescape(raw)
+		if err != nil {
+			return fmt.Errorf("%v: %s: %w", src, name, err)
+		}
+		p[name] = prop{raw: raw, value: value}
+		sources[name] = src
+		return nil
+	}
+
+	if l.File != "" {
+		if err := l.loadFile(p, sources); err != nil {
+			return nil, err
+		}
+	}
+
+	// without a prefix, PATH, HOME and the like would override the fields
+	// with the same names, so the process environment needs one.
+	env := l.Env
+	if env == nil && l.EnvPrefix != "" {
+		env = os.Environ()
+	}
+	vars := make(map[string]string, len(env))
+	for _, kv := range env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			vars[k] = v
+		}
+	}
+	for _, b := range bindings {
+		name := envName(l.EnvPrefix, b.name)
+		if value, ok := vars[name]; b.leaf && ok {
+			// the values are literal, the commas of the lists still separate.
+			if err := set(b.name, escape(value, ""), Source{Kind: SourceEnv, Location: name}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if l.Args != nil {
+		if err := l.parseFlags(bindings, set); err != nil {
+			return nil, err
+		}
+	}
+
+	// the defaults go last, so that they don't allocate the pointers.
+	for _, b := range bindings {
+		if b.plan.hasDefault && !p.has(b.name) && b.present(p) {
+			if err := set(b.name, b.plan.def, Source{Kind: SourceDefault}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := unmarshal(p, "", rv); err != nil {
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			return nil, err
+		}
+		src, ok := sources.lookup(perr.Key)
+		switch {
+		case ok:
+			return nil, fmt.Errorf("%v: %s: %w", src, perr.Key, perr.Err)
+		case perr.Key != "":
+			return nil, fmt.Errorf("%s: %w", perr.Key, perr.Err)
+		}
+		return nil, perr.Err
+	}
+
+	var errs []error
+	for _, b := range bindings {
+		if b.plan.required && !p.has(b.name) && b.present(p) {
+			errs = append(errs, &FieldError{
+				Field: b.field,
+				Name:  b.name,
+				Env:   envName(l.EnvPrefix, b.name),
+				Flag:  b.name,
+				Err:   ErrRequired,
+			})
+		}
+	}
+	if len(errs) > 0 {
+		return sources, errors.Join(errs...)
+	}
+	return sources, nil
+}
+
+func (l *Loader) loadFile(p props, sources Sources) error {
+	f, err := os.Open(l.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rows, err := readProps(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", l.File, err)
+	}
+	for name, row := range rows {
+		p[name] = row
+		sources[name] = Source{Kind: SourceFile, Location: fmt.Sprintf("%s:%d", l.File, row.line)}
+	}
+	return nil
+}
+
+// flagValue is a flag.Value that records the value for the later unmarshal.
+type flagValue struct {
+	b   binding
+	set func(name, raw string, src Source) error
+}
+
+func (f *flagValue) String() string {
+	if f == nil || !f.b.plan.hasDefault {
+		return ""
+	}
+	return f.b.plan.def
+}
+
+func (f *flagValue) Set(s string) error {
+	return f.set(f.b.name, escape(s, ""), Source{Kind: SourceFlag, Location: "-" + f.b.name})
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.b.typ.Kind() == reflect.Bool
+}
+
+func (l *Loader) parseFlags(bindings []binding, set func(name, raw string, src Source) error) error {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	if l.Output != nil {
+		fs.SetOutput(l.Output)
+	}
+
+	for _, b := range bindings {
+		if b.leaf {
+			fs.Var(&flagValue{b: b, set: set}, b.name, b.plan.usage)
+		}
+	}
+	if err := fs.Parse(l.Args); err != nil {
+		return err
+	}
+	l.Rest = fs.Args()
+	return nil
+}
+
+// bindingsOf returns the fields of the struct type t, recursively. The
+// structs are returned too, for the required option, but only the leaves
+// are bound to the variables and the flags. The recursive structs are
+// visited once.
+func bindingsOf(t reflect.Type, prefix, path, optional string, visited map[reflect.Type]bool) ([]binding, error) {
+	fields, err := planOf(t)
+	if err != nil {
+		return nil, err
+	}
+	visited[t] = true
+	defer delete(visited, t)
+
+	var result []binding
+	for _, f := range fields {
+		if f.inline {
+			continue
+		}
+
+		sf := t.FieldByIndex(f.index)
+		typ := sf.Type
+		for typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+
+		b := binding{name: join(prefix, f.name), field: joinPath(path, sf.Name), typ: typ, plan: f, optional: optional}
+		switch {
+		case readAsScalar(typ):
+			b.leaf = true
+		case typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array:
+			b.leaf = readAsScalar(typ.Elem())
+		}
+		result = append(result, b)
+
+		if !b.leaf && typ.Kind() == reflect.Struct && !visited[typ] && !implementsType(typ, propertiesUnmarshalerType) {
+			opt := optional
+			if sf.Type.Kind() == reflect.Ptr {
+				opt = b.name
+			}
+			nested, err := bindingsOf(typ, b.name, b.field, opt, visited)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, nested...)
+		}
+	}
+	return result, nil
+}
+
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// envName converts the property name to the variable name: server.maxConns
+// with the APP prefix is APP_SERVER_MAX_CONNS.
+func envName(prefix, name string) string {
+	var b strings.Builder
+	if prefix != "" {
+		b.WriteString(strings.ToUpper(prefix))
+		b.WriteByte('_')
+	}
+
+	var prev rune
+	for _, r := range name {
+		switch {
+		case unicode.IsUpper(r) && (unicode.IsLower(prev) || unicode.IsDigit(prev)):
+			b.WriteByte('_')
+			b.WriteRune(r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(unicode.ToUpper(r))
+		default:
+			b.WriteByte('_')
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+type (
+	DBConfig struct {
+		DSN      string `properties:"dsn,required" usage:"database connection string"`
+		MaxConns int    `properties:"maxConns,default=10"`
+	}
+
+	AppConfig struct {
+		Name    string        `properties:"name,default=app"`
+		Debug   bool          `properties:"debug" usage:"enable debug logs"`
+		Port    int           `properties:"port,required"`
+		Timeout time.Duration `properties:"timeout,default=5s"`
+		Hosts   []string      `properties:"hosts"`
+		DB      *DBConfig     `properties:"db"`
+		Labels  map[string]string
+		Parent  *AppConfig `properties:"-"`
+		Next    *AppConfig `properties:"next,omitempty"` // recursive, only read from the file.
+	}
+)
+
+func writeFile(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "app.properties")
+	assert.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	file := writeFile(t, "# application config\n"+
+		"port=8080\n"+
+		"timeout=10s\n"+
+		"db.dsn=postgres://file\n"+
+		"labels.env=prod\n")
+
+	l := Loader{
+		File:      file,
+		EnvPrefix: "app",
+		Env:       []string{"APP_PORT=9090", "APP_DB_MAX_CONNS=20", "APP_HOSTS=a,b", "PORT=1"},
+		Args:      []string{"-debug", "-db.dsn", "postgres://flag", "-port=7070", "rest"},
+	}
+
+	var c AppConfig
+	sources, err := l.Load(&c)
+	assert.NoError(t, err)
+	assert.Equal(t, AppConfig{
+		Name:    "app",
+		Debug:   true,
+		Port:    7070,
+		Timeout: 10 * time.Second,
+		Hosts:   []string{"a", "b"},
+		DB:      &DBConfig{DSN: "postgres://flag", MaxConns: 20},
+		Labels:  map[string]string{"env": "prod"},
+	}, c)
+
+	assert.Equal(t, Sources{
+		"name":        {Kind: SourceDefault},
+		"debug":       {Kind: SourceFlag, Location: "-debug"},
+		"port":        {Kind: SourceFlag, Location: "-port"},
+		"timeout":     {Kind: SourceFile, Location: file + ":3"},
+		"hosts":       {Kind: SourceEnv, Location: "APP_HOSTS"},
+		"db.dsn":      {Kind: SourceFlag, Location: "-db.dsn"},
+		"db.maxConns": {Kind: SourceEnv, Location: "APP_DB_MAX_CONNS"},
+		"labels.env":  {Kind: SourceFile, Location: file + ":5"},
+	}, sources)
+	assert.Equal(t, "env APP_HOSTS", sources["hosts"].String())
+	assert.Equal(t, []string{"rest"}, l.Rest)
+}
+
+func TestLoad_ProcessEnv(t *testing.T) {
+	t.Setenv("PORT", "1")
+	t.Setenv("APP_PORT", "2")
+	file := writeFile(t, "port=8080\n")
+
+	var c AppConfig
+	l := Loader{File: file}
+	sources, err := l.Load(&c)
+	assert.NoError(t, err)
+	assert.Equal(t, 8080, c.Port, "the process environment is not read without a prefix")
+	assert.Equal(t, SourceFile, sources["port"].Kind)
+
+	l = Loader{File: file, EnvPrefix: "APP"}
+	sources, err = l.Load(&c)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, c.Port)
+	assert.Equal(t, Source{Kind: SourceEnv, Location: "APP_PORT"}, sources["port"])
+}
+
+func TestLoad_Pointers(t *testing.T) {
+	l := Loader{Env: []string{"PORT=1"}}
+
+	var c AppConfig
+	sources, err := l.Load(&c)
+	assert.NoError(t, err)
+	assert.Nil(t, c.DB, "no source mentions db")
+	assert.Equal(t, Sources{
+		"name":    {Kind: SourceDefault},
+		"port":    {Kind: SourceEnv, Location: "PORT"},
+		"timeout": {Kind: SourceDefault},
+	}, sources)
+	assert.Nil(t, l.Rest)
+
+	l = Loader{Env: []string{"PORT=1"}, Args: []string{"-db.dsn=postgres://flag"}}
+	c = AppConfig{}
+	sources, err = l.Load(&c)
+	assert.NoError(t, err)
+	assert.Equal(t, &DBConfig{DSN: "postgres://flag", MaxConns: 10}, c.DB)
+	assert.Equal(t, Source{Kind: SourceDefault}, sources["db.maxConns"])
+	assert.Empty(t, l.Rest)
+}
+
+func TestLoad_Required(t *testing.T) {
+	l := Loader{Env: []string{}}
+
+	var c AppConfig
+	_, err := l.Load(&c)
+	assert.ErrorIs(t, err, ErrRequired)
+	assert.EqualError(t, err, "Port: property port is required (env PORT, flag -port)")
+	assert.Nil(t, c.DB, "the fields of a nil pointer aren't required")
+
+	l = Loader{EnvPrefix: "APP", Env: []string{"APP_PORT=1", "APP_DB_MAX_CONNS=1"}}
+	_, err = l.Load(&c)
+
+	var ferr *FieldError
+	assert.True(t, errors.As(err, &ferr))
+	assert.Equal(t, &FieldError{Field: "DB.DSN", Name: "db.dsn", Env: "APP_DB_DSN", Flag: "db.dsn", Err: ErrRequired}, ferr)
+}
+
+func TestLoad_Errors(t *testing.T) {
+	file := writeFile(t, "port=8080\n\ntimeout=soon\n")
+	nested := writeFile(t, "port=1\n\nname.first=john\n") // the source of name is the nested row.
+
+	tests := map[string]struct {
+		loader Loader
+		msg    string
+	}{
+		"file": {
+			loader: Loader{File: file, Env: []string{}},
+			msg:    "file " + file + `:3: timeout: time: invalid duration "soon"`,
+		},
+		"nested": {
+			loader: Loader{File: nested, Env: []string{}},
+			msg:    "file " + nested + ":3: name: unsupported type: string has nested rows",
+		},
+		"env": {
+			loader: Loader{File: file, Env: []string{"TIMEOUT=1s", "DB_MAX_CONNS=many"}},
+			msg:    `env DB_MAX_CONNS: db.maxConns: strconv.ParseInt: parsing "many": invalid syntax`,
+		},
+		"flag": {
+			loader: Loader{Env: []string{"TIMEOUT=1s"}, Args: []string{"-debug=maybe"}, Output: io.Discard},
+			msg:    `flag -debug: debug: strconv.ParseBool: parsing "maybe": invalid syntax`,
+		},
+		"unknown flag": {
+			loader: Loader{Env: []string{}, Args: []string{"-verbose"}, Output: io.Discard},
+			msg:    "flag provided but not defined: -verbose",
+		},
+		"missing file": {
+			loader: Loader{File: filepath.Join(t.TempDir(), "missing.properties")},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var c AppConfig
+			_, err := test.loader.Load(&c)
+			if test.msg == "" {
+				assert.ErrorIs(t, err, os.ErrNotExist)
+				return
+			}
+			assert.EqualError(t, err, test.msg)
+		})
+	}
+}
+
+func TestLoad_Usage(t *testing.T) {
+	var out strings.Builder
+	l := Loader{Env: []string{}, Args: []string{"-h"}, Output: &out}
+
+	var c AppConfig
+	_, err := l.Load(&c)
+	assert.ErrorIs(t, err, flag.ErrHelp)
+	assert.Contains(t, out.String(), "-db.dsn value\n    \tdatabase connection string\n")
+	assert.Contains(t, out.String(), "-db.maxConns value\n    \t (default 10)\n")
+	assert.Contains(t, out.String(), "-debug\n    \tenable debug logs\n")
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "APP_SERVER_MAX_CONNS", envName("app", "server.maxConns"))
+	assert.Equal(t, "HTTP2_ENABLED", envName("", "http2Enabled"))
+	assert.Equal(t, "X_API_KEY", envName("x", "api-key"))
+}
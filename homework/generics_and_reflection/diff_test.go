@@ -0,0 +1,915 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v -run 'Diff|Patch' .
+
+const (
+	diffTag       = "diff"
+	diffTokenSkip = "-"
+	diffTokenKey  = "key="
+)
+
+var (
+	ErrInvalidPath  = errors.New("invalid path")
+	ErrDuplicateKey = errors.New("duplicate key")
+)
+
+// ChangeKind is the op of the change in JSON Patch (RFC 6902).
+type ChangeKind string
+
+const (
+	Added    ChangeKind = "add"
+	Removed  ChangeKind = "remove"
+	Modified ChangeKind = "replace"
+	Moved    ChangeKind = "move"
+)
+
+// PathStep is a struct field, an index of a slice or an array, or a key of
+// a map, depending on Kind.
+type PathStep struct {
+	Kind  reflect.Kind // reflect.Struct, reflect.Slice or reflect.Map.
+	Field string
+	Index int
+	Key   any
+}
+
+func (s PathStep) String() string {
+	switch s.Kind {
+	case reflect.Struct:
+		return s.Field
+	case reflect.Slice:
+		return strconv.Itoa(s.Index)
+	}
+	return fmt.Sprint(s.Key)
+}
+
+// Path addresses a value from the root, e.g. Routes[2].Target.
+type Path []PathStep
+
+func (p Path) String() string {
+	var sb strings.Builder
+	for i, step := range p {
+		switch {
+		case step.Kind != reflect.Struct:
+			sb.WriteString("[" + step.String() + "]")
+		case i > 0:
+			sb.WriteString("." + step.Field)
+		default:
+			sb.WriteString(step.Field)
+		}
+	}
+	return sb.String()
+}
+
+// Pointer returns p as a JSON Pointer (RFC 6901).
+func (p Path) Pointer() string {
+	var sb strings.Builder
+	for _, step := range p {
+		sb.WriteString("/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(step.String()))
+	}
+	return sb.String()
+}
+
+func (p Path) field(name string) Path {
+	return append(p[:len(p):len(p)], PathStep{Kind: reflect.Struct, Field: name})
+}
+
+func (p Path) index(i int) Path {
+	return append(p[:len(p):len(p)], PathStep{Kind: reflect.Slice, Index: i})
+}
+
+func (p Path) key(k any) Path {
+	return append(p[:len(p):len(p)], PathStep{Kind: reflect.Map, Key: k})
+}
+
+// Change is a step of a Patch.
+type Change struct {
+	Kind ChangeKind
+	Path Path
+	From Path // the moved element, in the same slice, for Moved.
+	Old  any  // for Removed and Modified.
+	New  any  // for Added and Modified.
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case Added:
+		return fmt.Sprintf("+ %s: %s", c.Path, display(c.New))
+	case Removed:
+		return fmt.Sprintf("- %s: %s", c.Path, display(c.Old))
+	case Moved:
+		return fmt.Sprintf("> %s: moved from %s", c.Path, c.From)
+	}
+	return fmt.Sprintf("~ %s: %s -> %s", c.Path, display(c.Old), display(c.New))
+}
+
+// display formats a value of a change, following the pointers.
+func display(v any) string {
+	rv, ok := deref(reflect.ValueOf(v))
+	switch {
+	case !ok:
+		return "nil"
+	case rv.Kind() == reflect.String:
+		return strconv.Quote(rv.String())
+	}
+	return fmt.Sprintf("%+v", rv.Interface())
+}
+
+// Patch is the list of changes turning a value into another one, in the
+// order they apply.
+type Patch []Change
+
+// String renders the patch as text, a change per line.
+func (p Patch) String() string {
+	lines := make([]string, len(p))
+	for i, c := range p {
+		lines[i] = c.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+type jsonPatchOp struct {
+	Op    ChangeKind      `json:"op"`
+	From  string          `json:"from,omitempty"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// MarshalJSON renders the patch as JSON Patch (RFC 6902). The paths use the
+// names of the Go fields and the values are encoded by encoding/json.
+func (p Patch) MarshalJSON() ([]byte, error) {
+	ops := make([]jsonPatchOp, len(p))
+	for i, c := range p {
+		ops[i] = jsonPatchOp{Op: c.Kind, Path: c.Path.Pointer()}
+		switch c.Kind {
+		case Added, Modified:
+			value, err := json.Marshal(c.New)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", c.Path, err)
+			}
+			ops[i].Value = value
+		case Moved:
+			ops[i].From = c.From.Pointer()
+		}
+	}
+	return json.Marshal(ops)
+}
+
+// Diff returns the changes from a to b: the exported fields of the structs,
+// the elements of the slices and arrays and the entries of the maps are
+// compared recursively, the rest as a whole, the funcs are not compared.
+// A struct implementing encoding.TextMarshaler is compared by its text.
+// Two NaNs are equal, so a value is never different from itself.
+//
+// The slices are matched by index, or by the value of a field of their
+// elements with the tag `diff:"key=ID"`: the elements are removed, moved
+// and added to get the order of b. The fields tagged `diff:"-"` are
+// skipped. The values of the changes are copies, see Clone.
+func Diff[T any](a, b T) (Patch, error) {
+	d := differ{visited: make(map[diffVisit]bool)}
+	err := d.diff(nil, reflect.ValueOf(&a).Elem(), reflect.ValueOf(&b).Elem())
+	return d.patch, err
+}
+
+type diffVisit struct {
+	a, b uintptr
+	typ  reflect.Type
+}
+
+type differ struct {
+	patch   Patch
+	visited map[diffVisit]bool
+}
+
+func (d *differ) add(kind ChangeKind, path Path, a, b reflect.Value) {
+	c := Change{Kind: kind, Path: path}
+	if a.IsValid() {
+		c.Old = Clone(a.Interface())
+	}
+	if b.IsValid() {
+		c.New = Clone(b.Interface())
+	}
+	d.patch = append(d.patch, c)
+}
+
+func (d *differ) diff(path Path, a, b reflect.Value) error {
+	t := a.Type()
+	switch a.Kind() {
+	case reflect.Ptr:
+		if a.IsNil() || b.IsNil() {
+			if a.IsNil() != b.IsNil() {
+				d.add(Modified, path, a, b)
+			}
+			return nil
+		}
+		visit := diffVisit{a: a.Pointer(), b: b.Pointer(), typ: t}
+		if visit.a == visit.b || d.visited[visit] {
+			return nil
+		}
+		d.visited[visit] = true
+		return d.diff(path, a.Elem(), b.Elem())
+
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() || a.Elem().Type() != b.Elem().Type() {
+			if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+				d.add(Modified, path, a, b)
+			}
+			return nil
+		}
+		return d.diff(path, a.Elem(), b.Elem())
+
+	case reflect.Struct:
+		if implementsType(t, textMarshalerType) {
+			at, aerr := text(a)
+			bt, berr := text(b)
+			if aerr != nil || berr != nil || at != bt {
+				d.add(Modified, path, a, b)
+			}
+			return nil
+		}
+
+		fields, err := diffFieldsOf(t)
+		if err != nil {
+			return err
+		}
+		for _, f := range fields {
+			af, bf := a.Field(f.index), b.Field(f.index)
+			if f.key != nil {
+				err = d.diffKeyed(path.field(f.name), af, bf, f.key)
+			} else {
+				err = d.diff(path.field(f.name), af, bf)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		entries := make([]mapEntry, 0, a.Len()+b.Len())
+		for _, k := range a.MapKeys() {
+			entries = append(entries, mapEntry{key: k, name: v2s(k)})
+		}
+		for _, k := range b.MapKeys() {
+			if !a.MapIndex(k).IsValid() {
+				entries = append(entries, mapEntry{key: k, name: v2s(k)})
+			}
+		}
+		slices.SortFunc(entries, compareEntries)
+
+		for _, e := range entries {
+			av, bv := a.MapIndex(e.key), b.MapIndex(e.key)
+			switch k := path.key(e.key.Interface()); {
+			case !bv.IsValid():
+				d.add(Removed, k, av, reflect.Value{})
+			case !av.IsValid():
+				d.add(Added, k, reflect.Value{}, bv)
+			default:
+				if err := d.diff(k, av, bv); err != nil {
+					return err
+				}
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < min(a.Len(), b.Len()); i++ {
+			if err := d.diff(path.index(i), a.Index(i), b.Index(i)); err != nil {
+				return err
+			}
+		}
+		// from the end, so the indices stay valid.
+		for i := a.Len() - 1; i >= b.Len(); i-- {
+			d.add(Removed, path.index(i), a.Index(i), reflect.Value{})
+		}
+		for i := a.Len(); i < b.Len(); i++ {
+			d.add(Added, path.index(i), reflect.Value{}, b.Index(i))
+		}
+
+	case reflect.Func:
+
+	case reflect.Float32, reflect.Float64:
+		if !floatEqual(a.Float(), b.Float()) {
+			d.add(Modified, path, a, b)
+		}
+
+	case reflect.Complex64, reflect.Complex128:
+		x, y := a.Complex(), b.Complex()
+		if !floatEqual(real(x), real(y)) || !floatEqual(imag(x), imag(y)) {
+			d.add(Modified, path, a, b)
+		}
+
+	default:
+		if !a.Equal(b) {
+			d.add(Modified, path, a, b)
+		}
+	}
+	return nil
+}
+
+func floatEqual(x, y float64) bool {
+	return x == y || math.IsNaN(x) && math.IsNaN(y)
+}
+
+// diffKeyed matches the elements of the slices a and b by the field at
+// index key.
+func (d *differ) diffKeyed(path Path, a, b reflect.Value, key []int) error {
+	keysOf := func(s reflect.Value) ([]any, map[any]int, error) {
+		keys, indices := make([]any, s.Len()), make(map[any]int, s.Len())
+		for i := range keys {
+			elem, ok := deref(s.Index(i))
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: %w", path.index(i), ErrNilPtr)
+			}
+			keys[i] = elem.FieldByIndex(key).Interface()
+			if _, ok := indices[keys[i]]; ok {
+				return nil, nil, fmt.Errorf("%s: %w %v", path, ErrDuplicateKey, keys[i])
+			}
+			indices[keys[i]] = i
+		}
+		return keys, indices, nil
+	}
+
+	akeys, aindices, err := keysOf(a)
+	if err != nil {
+		return err
+	}
+	bkeys, bindices, err := keysOf(b)
+	if err != nil {
+		return err
+	}
+
+	// from the end, so the indices stay valid.
+	for i := len(akeys) - 1; i >= 0; i-- {
+		if _, ok := bindices[akeys[i]]; !ok {
+			d.add(Removed, path.index(i), a.Index(i), reflect.Value{})
+		}
+	}
+	cur := slices.DeleteFunc(slices.Clone(akeys), func(k any) bool {
+		_, ok := bindices[k]
+		return !ok
+	})
+
+	// cur[:i] is in the order of b.
+	for i, k := range bkeys {
+		if i < len(cur) && cur[i] == k {
+			continue
+		}
+		if j := slices.Index(cur, k); j >= 0 {
+			d.patch = append(d.patch, Change{Kind: Moved, Path: path.index(i), From: path.index(j)})
+			cur = slices.Delete(cur, j, j+1)
+		} else {
+			d.add(Added, path.index(i), reflect.Value{}, b.Index(i))
+		}
+		cur = slices.Insert(cur, i, k)
+	}
+
+	for i, k := range bkeys {
+		if j, ok := aindices[k]; ok {
+			if err := d.diff(path.index(i), a.Index(j), b.Index(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type diffField struct {
+	index int
+	name  string
+	key   []int // of the elements of a slice matched by key.
+}
+
+type diffPlan struct {
+	fields []diffField
+	err    error
+}
+
+var diffPlans sync.Map // reflect.Type -> *diffPlan
+
+func diffFieldsOf(t reflect.Type) ([]diffField, error) {
+	p, ok := diffPlans.Load(t)
+	if !ok {
+		p, _ = diffPlans.LoadOrStore(t, buildDiffPlan(t))
+	}
+	plan := p.(*diffPlan)
+	return plan.fields, plan.err
+}
+
+func buildDiffPlan(t reflect.Type) *diffPlan {
+	var fields []diffField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get(diffTag)
+		if !f.IsExported() || tag == diffTokenSkip {
+			continue
+		}
+
+		field := diffField{index: i, name: f.Name}
+		if tag != "" {
+			key, err := diffKey(f.Type, tag)
+			if err != nil {
+				return &diffPlan{err: fmt.Errorf("field %s.%s: %w", t, f.Name, err)}
+			}
+			field.key = key
+		}
+		fields = append(fields, field)
+	}
+	return &diffPlan{fields: fields}
+}
+
+// diffKey returns the index of the key field of the elements of t.
+func diffKey(t reflect.Type, tag string) ([]int, error) {
+	name, ok := strings.CutPrefix(tag, diffTokenKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, tag)
+	}
+	if t.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("%w: %s can't be matched by key", ErrInvalidToken, t)
+	}
+
+	elem := t.Elem()
+	for elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	if elem.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%w: %s can't be matched by key", ErrInvalidToken, t)
+	}
+	f, ok := elem.FieldByName(name)
+	if !ok || !f.IsExported() || !f.Type.Comparable() {
+		return nil, fmt.Errorf("%w: %s has no comparable field %s", ErrInvalidToken, elem, name)
+	}
+	return f.Index, nil
+}
+
+// Apply applies the changes to v, a pointer to a struct, in order. The
+// changes are applied until the first one failing.
+func (p Patch) Apply(v any) error {
+	rv, err := target(v)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range p {
+		if err := apply(rv, c.Path, c); err != nil {
+			return fmt.Errorf("%s %s: %w", c.Kind, c.Path, err)
+		}
+	}
+	return nil
+}
+
+// apply applies c to the value at path in v, a settable value.
+func apply(v reflect.Value, path Path, c Change) error {
+	if len(path) == 0 {
+		if c.Kind != Modified {
+			return ErrInvalidPath
+		}
+		return set(v, c.New)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return ErrNilPtr
+		}
+		return apply(v.Elem(), path, c)
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return ErrNilPtr
+		}
+		elem := reflect.New(v.Elem().Type()).Elem()
+		elem.Set(v.Elem())
+		if err := apply(elem, path, c); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	}
+
+	step, last := path[0], len(path) == 1
+	switch {
+	case v.Kind() == reflect.Struct && step.Kind == reflect.Struct:
+		f := v.FieldByName(step.Field)
+		if !f.IsValid() || !f.CanSet() {
+			return fmt.Errorf("%w: no field %s", ErrInvalidPath, step.Field)
+		}
+		switch {
+		case !last:
+			return apply(f, path[1:], c)
+		case c.Kind == Removed:
+			f.SetZero()
+			return nil
+		}
+		return set(f, c.New)
+
+	case v.Kind() == reflect.Map && step.Kind == reflect.Map:
+		k, err := valueOf(step.Key, v.Type().Key())
+		if err != nil {
+			return err
+		}
+		if !last {
+			cur := v.MapIndex(k)
+			if !cur.IsValid() {
+				return fmt.Errorf("%w: no key %v", ErrInvalidPath, step.Key)
+			}
+			elem := reflect.New(cur.Type()).Elem()
+			elem.Set(cur)
+			if err := apply(elem, path[1:], c); err != nil {
+				return err
+			}
+			v.SetMapIndex(k, elem)
+			return nil
+		}
+
+		switch c.Kind {
+		case Removed:
+			v.SetMapIndex(k, reflect.Value{})
+			return nil
+		case Moved:
+			return fmt.Errorf("%w: can't move a key", ErrInvalidPath)
+		}
+		elem, err := valueOf(c.New, v.Type().Elem())
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		v.SetMapIndex(k, elem)
+		return nil
+
+	case (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && step.Kind == reflect.Slice:
+		return applyIndex(v, step.Index, path[1:], c)
+	}
+	return fmt.Errorf("%w: %s step in %s", ErrInvalidPath, step.Kind, v.Type())
+}
+
+func applyIndex(v reflect.Value, i int, rest Path, c Change) error {
+	size := v.Len()
+	if c.Kind == Added && len(rest) == 0 {
+		size++ // appending.
+	}
+	if i < 0 || i >= size {
+		return fmt.Errorf("%w: index %d out of range", ErrInvalidPath, i)
+	}
+	if len(rest) > 0 || c.Kind == Modified {
+		return apply(v.Index(i), rest, c)
+	}
+	if v.Kind() == reflect.Array {
+		return fmt.Errorf("%w: can't %s an element of %s", ErrInvalidPath, c.Kind, v.Type())
+	}
+
+	var elem reflect.Value
+	switch c.Kind {
+	case Added:
+		var err error
+		if elem, err = valueOf(c.New, v.Type().Elem()); err != nil {
+			return err
+		}
+	case Moved:
+		from, err := moveSource(c)
+		if err != nil {
+			return err
+		}
+		if from < 0 || from >= v.Len() {
+			return fmt.Errorf("%w: index %d out of range", ErrInvalidPath, from)
+		}
+		elem = v.Index(from)
+		v.Set(remove(v, from))
+	case Removed:
+		v.Set(remove(v, i))
+		return nil
+	}
+
+	s := reflect.MakeSlice(v.Type(), 0, v.Len()+1)
+	s = reflect.AppendSlice(s, v.Slice(0, i))
+	s = reflect.Append(s, elem)
+	v.Set(reflect.AppendSlice(s, v.Slice(i, v.Len())))
+	return nil
+}
+
+// moveSource returns the index the element of a Moved change comes from,
+// c.From must be the path of an element of the same slice as c.Path.
+func moveSource(c Change) (int, error) {
+	n := len(c.Path)
+	if len(c.From) != n || c.From[n-1].Kind != reflect.Slice {
+		return 0, fmt.Errorf("%w: from %q isn't an element of the slice", ErrInvalidPath, c.From.String())
+	}
+	for i := range n - 1 {
+		if !reflect.DeepEqual(c.From[i], c.Path[i]) {
+			return 0, fmt.Errorf("%w: from %q isn't an element of the slice", ErrInvalidPath, c.From.String())
+		}
+	}
+	return c.From[n-1].Index, nil
+}
+
+// remove returns a copy of the slice s without the element i.
+func remove(s reflect.Value, i int) reflect.Value {
+	out := reflect.MakeSlice(s.Type(), 0, s.Len()-1)
+	out = reflect.AppendSlice(out, s.Slice(0, i))
+	return reflect.AppendSlice(out, s.Slice(i+1, s.Len()))
+}
+
+// set sets v to x, or the value v points to, as Diff follows the pointers.
+func set(v reflect.Value, x any) error {
+	for v.Kind() == reflect.Ptr && x != nil && !reflect.TypeOf(x).AssignableTo(v.Type()) {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	rv, err := valueOf(x, v.Type())
+	if err != nil {
+		return err
+	}
+	v.Set(rv)
+	return nil
+}
+
+// valueOf returns a copy of x as a value of type t, the zero value for nil.
+// A number is converted to the other number types, e.g. the float64 of a
+// patch read from JSON, the other values must be assignable to t.
+func valueOf(x any, t reflect.Type) (reflect.Value, error) {
+	if x == nil {
+		return reflect.Zero(t), nil
+	}
+
+	rv := reflect.ValueOf(Clone(x))
+	switch {
+	case rv.Type().AssignableTo(t):
+		return rv, nil
+	case isNumber(rv.Kind()) && isNumber(t.Kind()) && rv.Type().ConvertibleTo(t):
+		return rv.Convert(t), nil
+	}
+	return rv, fmt.Errorf("%w: can't use %T as %s", ErrUnsupportedType, x, t)
+}
+
+func isNumber(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Complex128
+}
+
+type (
+	Route struct {
+		ID     string
+		Target string
+		Weight int
+	}
+
+	Listener struct {
+		Name string
+		Port int
+	}
+
+	Deployment struct {
+		Name      string
+		Replicas  int
+		Image     *string
+		Labels    map[string]string
+		Ports     []int
+		Zones     [3]string
+		Listeners []Listener
+		Routes    []*Route `diff:"key=ID"`
+		Limits    struct {
+			CPU    float64
+			Memory string
+		}
+		Updated time.Time
+		Extra   any
+		Notes   string `diff:"-"`
+	}
+)
+
+func deployment() Deployment {
+	d := Deployment{
+		Name:      "api",
+		Replicas:  2,
+		Image:     ptr("api:1.0"),
+		Labels:    map[string]string{"env": "prod", "team": "core"},
+		Ports:     []int{80, 443},
+		Listeners: []Listener{{Name: "http", Port: 80}},
+		Routes: []*Route{
+			{ID: "a", Target: "svc-a", Weight: 10},
+			{ID: "b", Target: "svc-b", Weight: 20},
+			{ID: "c", Target: "svc-c", Weight: 30},
+		},
+		Updated: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		Extra:   map[string]any{"debug": false},
+		Notes:   "first",
+	}
+	d.Limits.CPU, d.Limits.Memory = 0.5, "256Mi"
+	return d
+}
+
+func TestDiff(t *testing.T) {
+	a := deployment()
+	b := Clone(a)
+	patch, err := Diff(a, b)
+	assert.NoError(t, err)
+	assert.Empty(t, patch)
+
+	b.Replicas = 3
+	*b.Image = "api:1.1"
+	delete(b.Labels, "team")
+	b.Labels["region"] = "eu"
+	b.Ports = []int{8080}
+	b.Listeners = append(b.Listeners, Listener{Name: "grpc", Port: 9090})
+	b.Limits.Memory = "512Mi"
+	b.Updated = b.Updated.Add(time.Hour)
+	b.Extra.(map[string]any)["debug"] = true
+	b.Notes = "ignored"
+
+	patch, err = Diff(a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, `~ Replicas: 2 -> 3
+~ Image: "api:1.0" -> "api:1.1"
++ Labels[region]: "eu"
+- Labels[team]: "core"
+~ Ports[0]: 80 -> 8080
+- Ports[1]: 443
++ Listeners[1]: {Name:grpc Port:9090}
+~ Limits.Memory: "256Mi" -> "512Mi"
+~ Updated: 2024-03-01 00:00:00 +0000 UTC -> 2024-03-01 01:00:00 +0000 UTC
+~ Extra[debug]: false -> true`, patch.String())
+
+	data, err := json.Marshal(patch)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/Replicas", "value": 3},
+		{"op": "replace", "path": "/Image", "value": "api:1.1"},
+		{"op": "add", "path": "/Labels/region", "value": "eu"},
+		{"op": "remove", "path": "/Labels/team"},
+		{"op": "replace", "path": "/Ports/0", "value": 8080},
+		{"op": "remove", "path": "/Ports/1"},
+		{"op": "add", "path": "/Listeners/1", "value": {"Name": "grpc", "Port": 9090}},
+		{"op": "replace", "path": "/Limits/Memory", "value": "512Mi"},
+		{"op": "replace", "path": "/Updated", "value": "2024-03-01T01:00:00Z"},
+		{"op": "replace", "path": "/Extra/debug", "value": true}
+	]`, string(data))
+
+	out := Clone(a)
+	assert.NoError(t, patch.Apply(&out))
+	b.Notes = a.Notes
+	assert.Equal(t, b, out)
+	assert.Equal(t, deployment(), a, "the source is left alone")
+}
+
+func TestDiff_Keyed(t *testing.T) {
+	a := deployment()
+	b := Clone(a)
+	b.Routes = []*Route{
+		{ID: "c", Target: "svc-c", Weight: 30},
+		{ID: "d", Target: "svc-d", Weight: 5},
+		{ID: "a", Target: "svc-a2", Weight: 10},
+	}
+
+	patch, err := Diff(a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, `- Routes[1]: {ID:b Target:svc-b Weight:20}
+> Routes[0]: moved from Routes[1]
++ Routes[1]: {ID:d Target:svc-d Weight:5}
+~ Routes[2].Target: "svc-a" -> "svc-a2"`, patch.String())
+
+	data, err := json.Marshal(patch)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"op": "remove", "path": "/Routes/1"},
+		{"op": "move", "from": "/Routes/1", "path": "/Routes/0"},
+		{"op": "add", "path": "/Routes/1", "value": {"ID": "d", "Target": "svc-d", "Weight": 5}},
+		{"op": "replace", "path": "/Routes/2/Target", "value": "svc-a2"}
+	]`, string(data))
+
+	out := Clone(a)
+	assert.NoError(t, patch.Apply(&out))
+	assert.Equal(t, b, out)
+
+	b.Routes = append(b.Routes, &Route{ID: "a"})
+	_, err = Diff(a, b)
+	assert.ErrorIs(t, err, ErrDuplicateKey)
+	assert.EqualError(t, err, "Routes: duplicate key a")
+}
+
+func TestDiff_Cycles(t *testing.T) {
+	a := &GraphNode{Name: "a"}
+	c := &GraphNode{Name: "c"}
+	a.Edges = []*GraphNode{c, a}
+	c.Edges = []*GraphNode{a}
+
+	b := Clone(a)
+	patch, err := Diff(a, b)
+	assert.NoError(t, err)
+	assert.Empty(t, patch)
+
+	b.Edges[0].Edges[0].Name = "changed"
+	patch, err = Diff(a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, `~ Name: "a" -> "changed"`, patch.String(), "the first path to a value is reported")
+}
+
+func TestDiff_NaN(t *testing.T) {
+	type Sample struct {
+		Value  float64
+		Values []float32
+		Phase  complex128
+	}
+
+	nan := math.NaN()
+	a := Sample{Value: nan, Values: []float32{1, float32(nan)}, Phase: complex(0, nan)}
+	patch, err := Diff(a, a)
+	assert.NoError(t, err)
+	assert.Empty(t, patch)
+
+	b := Clone(a)
+	b.Value, b.Values[1] = 1, 2
+	patch, err = Diff(a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "~ Value: NaN -> 1\n~ Values[1]: NaN -> 2", patch.String())
+}
+
+func TestDiff_InvalidTag(t *testing.T) {
+	type NotSlice struct {
+		Route Route `diff:"key=ID"`
+	}
+	_, err := Diff(NotSlice{}, NotSlice{})
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	assert.EqualError(t, err, "field main.NotSlice.Route: invalid token: main.Route can't be matched by key")
+
+	type NoField struct {
+		Routes []Route `diff:"key=Name"`
+	}
+	_, err = Diff(NoField{}, NoField{})
+	assert.EqualError(t, err, "field main.NoField.Routes: invalid token: main.Route has no comparable field Name")
+
+	type Unknown struct {
+		Routes []Route `diff:"match"`
+	}
+	_, err = Diff(Unknown{}, Unknown{})
+	assert.EqualError(t, err, "field main.Unknown.Routes: invalid token: match")
+}
+
+func TestPatch_Apply_Errors(t *testing.T) {
+	d := deployment()
+	assert.ErrorIs(t, Patch{}.Apply(d), ErrNotAPointer)
+
+	tests := map[string]struct {
+		change Change
+		msg    string
+	}{
+		"unknown field": {
+			change: Change{Kind: Modified, Path: Path(nil).field("Version"), New: 1},
+			msg:    "replace Version: invalid path: no field Version",
+		},
+		"out of range": {
+			change: Change{Kind: Modified, Path: Path(nil).field("Ports").index(5), New: 1},
+			msg:    "replace Ports[5]: invalid path: index 5 out of range",
+		},
+		"missing key": {
+			change: Change{Kind: Modified, Path: Path(nil).field("Labels").key("app").field("Name"), New: 1},
+			msg:    "replace Labels[app].Name: invalid path: no key app",
+		},
+		"wrong step": {
+			change: Change{Kind: Modified, Path: Path(nil).field("Name").index(0), New: "x"},
+			msg:    "replace Name[0]: invalid path: slice step in string",
+		},
+		"wrong type": {
+			change: Change{Kind: Modified, Path: Path(nil).field("Replicas"), New: "three"},
+			msg:    "replace Replicas: unsupported type: can't use string as int",
+		},
+		"number as string": {
+			change: Change{Kind: Modified, Path: Path(nil).field("Name"), New: 65},
+			msg:    "replace Name: unsupported type: can't use int as string",
+		},
+		"slice as array": {
+			change: Change{Kind: Modified, Path: Path(nil).field("Zones"), New: []string{"a"}},
+			msg:    "replace Zones: unsupported type: can't use []string as [3]string",
+		},
+		"move without from": {
+			change: Change{Kind: Moved, Path: Path(nil).field("Ports").index(0)},
+			msg:    `move Ports[0]: invalid path: from "" isn't an element of the slice`,
+		},
+		"move from another slice": {
+			change: Change{Kind: Moved, Path: Path(nil).field("Ports").index(0), From: Path(nil).field("Listeners").index(0)},
+			msg:    `move Ports[0]: invalid path: from "Listeners[0]" isn't an element of the slice`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.EqualError(t, Patch{test.change}.Apply(&d), test.msg)
+		})
+	}
+}
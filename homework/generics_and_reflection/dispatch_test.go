@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v -run 'Dispatcher' .
+
+const dispatchNameSep = "."
+
+var (
+	ErrUnknownMethod     = errors.New("unknown method")
+	ErrArgCount          = errors.New("wrong number of arguments")
+	ErrAlreadyRegistered = errors.New("already registered")
+	ErrMethodPanic       = errors.New("method panicked")
+)
+
+var (
+	errorType   = reflect.TypeFor[error]()
+	contextType = reflect.TypeFor[context.Context]()
+)
+
+// Dispatcher calls the registered methods and funcs by name, converting
+// the arguments from strings or JSON. A method or a func can be called if
+// it returns nothing, a value, an error or a value and an error. A
+// context.Context first parameter gets the context of the call and is not
+// an argument. A panic of a method is returned as an error matching
+// ErrMethodPanic.
+type Dispatcher struct {
+	mu      sync.RWMutex
+	methods map[string]*method
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{methods: make(map[string]*method)}
+}
+
+// Register exposes the exported methods of rcvr as name.Method, name is
+// the name of the type of rcvr if empty. The methods that can't be called
+// are skipped, as in net/rpc.
+func (d *Dispatcher) Register(name string, rcvr any) error {
+	v := reflect.ValueOf(rcvr)
+	if !v.IsValid() || v.Kind() == reflect.Ptr && v.IsNil() {
+		return ErrNilPtr
+	}
+	if name == "" {
+		name = reflect.Indirect(v).Type().Name()
+	}
+	if name == "" {
+		return fmt.Errorf("%w: %s has no name", ErrUnsupportedType, v.Type())
+	}
+
+	var methods []*method
+	for i := 0; i < v.NumMethod(); i++ {
+		if m, ok := newMethod(name+dispatchNameSep+v.Type().Method(i).Name, v.Method(i)); ok {
+			methods = append(methods, m)
+		}
+	}
+	if len(methods) == 0 {
+		return fmt.Errorf("%w: %s has no methods to dispatch", ErrUnsupportedType, v.Type())
+	}
+	return d.add(methods...)
+}
+
+// RegisterFunc exposes fn as name.
+func (d *Dispatcher) RegisterFunc(name string, fn any) error {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return fmt.Errorf("%w: %T isn't a func", ErrUnsupportedType, fn)
+	}
+
+	m, ok := newMethod(name, v)
+	if !ok {
+		return fmt.Errorf("%w: %s can't be dispatched", ErrUnsupportedType, v.Type())
+	}
+	return d.add(m)
+}
+
+func (d *Dispatcher) add(methods ...*method) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, m := range methods {
+		if _, ok := d.methods[m.name]; ok {
+			return fmt.Errorf("%w: %s", ErrAlreadyRegistered, m.name)
+		}
+	}
+	for _, m := range methods {
+		d.methods[m.name] = m
+	}
+	return nil
+}
+
+func (d *Dispatcher) method(name string) (*method, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	m, ok := d.methods[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMethod, name)
+	}
+	return m, nil
+}
+
+// Call calls the method with the arguments as strings: the scalars are
+// parsed as by Unmarshal, the rest as JSON.
+func (d *Dispatcher) Call(ctx context.Context, name string, args ...string) (any, error) {
+	m, err := d.method(name)
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := m.args(len(args), func(i int, t reflect.Type) (reflect.Value, error) {
+		v := reflect.New(t).Elem()
+		if readAsScalar(t) {
+			return v, setScalar(v, args[i])
+		}
+		return v, json.Unmarshal([]byte(args[i]), v.Addr().Interface())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m.call(ctx, in)
+}
+
+// CallJSON calls the method with the arguments as a JSON array.
+func (d *Dispatcher) CallJSON(ctx context.Context, name string, data []byte) (any, error) {
+	m, err := d.method(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []json.RawMessage
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &args); err != nil {
+			return nil, fmt.Errorf("%s: arguments: %w", name, err)
+		}
+	}
+
+	in, err := m.args(len(args), func(i int, t reflect.Type) (reflect.Value, error) {
+		v := reflect.New(t)
+		return v.Elem(), json.Unmarshal(args[i], v.Interface())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m.call(ctx, in)
+}
+
+// Methods returns the signatures of the registered methods and funcs,
+// sorted by name.
+func (d *Dispatcher) Methods() []Signature {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	sigs := make([]Signature, 0, len(d.methods))
+	for _, name := range slices.Sorted(maps.Keys(d.methods)) {
+		sigs = append(sigs, d.methods[name].signature())
+	}
+	return sigs
+}
+
+// Signature describes a method or a func without its context parameter.
+type Signature struct {
+	Name     string
+	In       []reflect.Type
+	Variadic bool
+	Out      []reflect.Type
+}
+
+func (s Signature) String() string {
+	in := make([]string, len(s.In))
+	for i, t := range s.In {
+		in[i] = t.String()
+	}
+	if s.Variadic {
+		in[len(in)-1] = "..." + s.In[len(in)-1].Elem().String()
+	}
+
+	out := make([]string, len(s.Out))
+	for i, t := range s.Out {
+		out[i] = t.String()
+	}
+
+	sig := s.Name + "(" + strings.Join(in, ", ") + ")"
+	switch len(out) {
+	case 0:
+		return sig
+	case 1:
+		return sig + " " + out[0]
+	}
+	return sig + " (" + strings.Join(out, ", ") + ")"
+}
+
+type method struct {
+	name     string
+	fn       reflect.Value
+	ctx      bool
+	in       []reflect.Type // the arguments, without the context.
+	variadic bool
+	result   bool
+	err      bool
+}
+
+func newMethod(name string, fn reflect.Value) (*method, bool) {
+	t := fn.Type()
+	m := &method{name: name, fn: fn, variadic: t.IsVariadic()}
+	for i := 0; i < t.NumIn(); i++ {
+		if i == 0 && t.In(i) == contextType {
+			m.ctx = true
+			continue
+		}
+		m.in = append(m.in, t.In(i))
+	}
+
+	switch t.NumOut() {
+	case 0:
+	case 1:
+		m.err = t.Out(0) == errorType
+		m.result = !m.err
+	case 2:
+		if t.Out(1) != errorType {
+			return nil, false
+		}
+		m.result, m.err = true, true
+	default:
+		return nil, false
+	}
+	return m, true
+}
+
+func (m *method) signature() Signature {
+	sig := Signature{Name: m.name, In: m.in, Variadic: m.variadic}
+	for i := 0; i < m.fn.Type().NumOut(); i++ {
+		sig.Out = append(sig.Out, m.fn.Type().Out(i))
+	}
+	return sig
+}
+
+// args converts n arguments with conv, the extra ones of a variadic method
+// to the type of its elements.
+func (m *method) args(n int, conv func(i int, t reflect.Type) (reflect.Value, error)) ([]reflect.Value, error) {
+	fixed := len(m.in)
+	if m.variadic {
+		fixed--
+	}
+	switch {
+	case m.variadic && n < fixed:
+		return nil, fmt.Errorf("%s: %w: want at least %d, got %d", m.name, ErrArgCount, fixed, n)
+	case !m.variadic && n != fixed:
+		return nil, fmt.Errorf("%s: %w: want %d, got %d", m.name, ErrArgCount, fixed, n)
+	}
+
+	in := make([]reflect.Value, n)
+	for i := range in {
+		t := m.in[min(i, len(m.in)-1)]
+		if i >= fixed {
+			t = t.Elem()
+		}
+
+		v, err := conv(i, t)
+		if err != nil {
+			return nil, fmt.Errorf("%s: argument %d: %w", m.name, i+1, err)
+		}
+		in[i] = v
+	}
+	return in, nil
+}
+
+func (m *method) call(ctx context.Context, in []reflect.Value) (result any, err error) {
+	if m.ctx {
+		in = append([]reflect.Value{reflect.ValueOf(&ctx).Elem()}, in...)
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			if e, ok := v.(error); ok {
+				err = fmt.Errorf("%s: %w: %w", m.name, ErrMethodPanic, e)
+			} else {
+				err = fmt.Errorf("%s: %w: %v", m.name, ErrMethodPanic, v)
+			}
+		}
+	}()
+	out := m.fn.Call(in)
+	if m.err {
+		if e := out[len(out)-1]; !e.IsNil() {
+			err = e.Interface().(error)
+		}
+	}
+	if m.result {
+		result = out[0].Interface()
+	}
+	return result, err
+}
+
+var ErrDivByZero = errors.New("division by zero")
+
+type (
+	Point struct {
+		X, Y int
+	}
+
+	Calculator struct {
+		memory float64
+	}
+)
+
+func (c *Calculator) Add(a, b int) int {
+	return a + b
+}
+
+func (c *Calculator) Sum(nums ...float64) float64 {
+	var sum float64
+	for _, n := range nums {
+		sum += n
+	}
+	return sum
+}
+
+func (c *Calculator) Div(a, b float64) (float64, error) {
+	if b == 0 {
+		return 0, ErrDivByZero
+	}
+	return a / b, nil
+}
+
+func (c *Calculator) Join(sep string, parts ...string) string {
+	return strings.Join(parts, sep)
+}
+
+func (c *Calculator) Scale(p Point, k int) Point {
+	return Point{X: p.X * k, Y: p.Y * k}
+}
+
+func (c *Calculator) Store(v float64) {
+	c.memory = v
+}
+
+func (c *Calculator) Recall() float64 {
+	return c.memory
+}
+
+func (c *Calculator) Wait(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// MinMax returns two values, so it's not dispatched.
+func (c *Calculator) MinMax(a, b int) (int, int) {
+	return min(a, b), max(a, b)
+}
+
+func newCalculator(t *testing.T) *Dispatcher {
+	d := NewDispatcher()
+	assert.NoError(t, d.Register("", &Calculator{}))
+	assert.NoError(t, d.RegisterFunc("upper", strings.ToUpper))
+	return d
+}
+
+func TestDispatcher_Call(t *testing.T) {
+	d := newCalculator(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		args []string
+		out  any
+	}{
+		{name: "Calculator.Add", args: []string{"1", "2"}, out: 3},
+		{name: "Calculator.Sum", out: 0.0},
+		{name: "Calculator.Sum", args: []string{"1.5", "2", "-0.5"}, out: 3.0},
+		{name: "Calculator.Div", args: []string{"1", "4"}, out: 0.25},
+		{name: "Calculator.Join", args: []string{"-", "a", "b", "c"}, out: "a-b-c"},
+		{name: "Calculator.Scale", args: []string{`{"X": 1, "Y": 2}`, "3"}, out: Point{X: 3, Y: 6}},
+		{name: "Calculator.Wait", args: []string{"1ms"}},
+		{name: "upper", args: []string{"text"}, out: "TEXT"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := d.Call(ctx, test.name, test.args...)
+			assert.NoError(t, err)
+			assert.Equal(t, test.out, out)
+		})
+	}
+
+	out, err := d.Call(ctx, "Calculator.Store", "42")
+	assert.NoError(t, err)
+	assert.Nil(t, out)
+	out, err = d.Call(ctx, "Calculator.Recall")
+	assert.NoError(t, err)
+	assert.Equal(t, 42.0, out)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = d.Call(ctx, "Calculator.Wait", "1h")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDispatcher_Errors(t *testing.T) {
+	d := newCalculator(t)
+	ctx := context.Background()
+
+	tests := map[string]struct {
+		name string
+		args []string
+		err  error
+		msg  string
+	}{
+		"unknown": {
+			name: "Calculator.Mul", args: []string{"1", "2"},
+			err: ErrUnknownMethod, msg: "unknown method: Calculator.Mul",
+		},
+		"not dispatched": {
+			name: "Calculator.MinMax", args: []string{"1", "2"},
+			err: ErrUnknownMethod, msg: "unknown method: Calculator.MinMax",
+		},
+		"too few": {
+			name: "Calculator.Add", args: []string{"1"},
+			err: ErrArgCount, msg: "Calculator.Add: wrong number of arguments: want 2, got 1",
+		},
+		"too few for variadic": {
+			name: "Calculator.Join",
+			err:  ErrArgCount, msg: "Calculator.Join: wrong number of arguments: want at least 1, got 0",
+		},
+		"invalid argument": {
+			name: "Calculator.Add", args: []string{"1", "two"},
+			msg: `Calculator.Add: argument 2: strconv.ParseInt: parsing "two": invalid syntax`,
+		},
+		"invalid JSON argument": {
+			name: "Calculator.Scale", args: []string{"{", "1"},
+			msg: "Calculator.Scale: argument 1: unexpected end of JSON input",
+		},
+		"returned error": {
+			name: "Calculator.Div", args: []string{"1", "0"},
+			err: ErrDivByZero, msg: "division by zero",
+		},
+		"panic": {
+			name: "first", args: []string{"", "x"},
+			err: ErrMethodPanic, msg: "first: method panicked: no parts",
+		},
+		"runtime panic": {
+			name: "percent", args: []string{"1", "0"},
+			err: ErrMethodPanic, msg: "percent: method panicked: runtime error: integer divide by zero",
+		},
+	}
+
+	assert.NoError(t, d.RegisterFunc("first", func(sep, s string) string {
+		if sep == "" {
+			panic("no parts")
+		}
+		first, _, _ := strings.Cut(s, sep)
+		return first
+	}))
+	assert.NoError(t, d.RegisterFunc("percent", func(a, b int) int { return 100 * a / b }))
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := d.Call(ctx, test.name, test.args...)
+			if test.err != nil {
+				assert.ErrorIs(t, err, test.err)
+			}
+			assert.EqualError(t, err, test.msg)
+		})
+	}
+}
+
+func TestDispatcher_CallJSON(t *testing.T) {
+	d := newCalculator(t)
+	ctx := context.Background()
+
+	out, err := d.CallJSON(ctx, "Calculator.Scale", []byte(`[{"X": 2, "Y": -1}, 2]`))
+	assert.NoError(t, err)
+	assert.Equal(t, Point{X: 4, Y: -2}, out)
+
+	out, err = d.CallJSON(ctx, "Calculator.Join", []byte(`[", ", "a", "b"]`))
+	assert.NoError(t, err)
+	assert.Equal(t, "a, b", out)
+
+	out, err = d.CallJSON(ctx, "Calculator.Sum", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, out)
+
+	_, err = d.CallJSON(ctx, "Calculator.Add", []byte(`{"a": 1}`))
+	assert.ErrorContains(t, err, "Calculator.Add: arguments: json: cannot unmarshal object")
+
+	_, err = d.CallJSON(ctx, "Calculator.Add", []byte(`[1, "2"]`))
+	assert.EqualError(t, err, "Calculator.Add: argument 2: json: cannot unmarshal string into Go value of type int")
+}
+
+func TestDispatcher_Methods(t *testing.T) {
+	d := newCalculator(t)
+
+	sigs := make([]string, 0)
+	for _, sig := range d.Methods() {
+		sigs = append(sigs, sig.String())
+	}
+	assert.Equal(t, []string{
+		"Calculator.Add(int, int) int",
+		"Calculator.Div(float64, float64) (float64, error)",
+		"Calculator.Join(string, ...string) string",
+		"Calculator.Recall() float64",
+		"Calculator.Scale(main.Point, int) main.Point",
+		"Calculator.Store(float64)",
+		"Calculator.Sum(...float64) float64",
+		"Calculator.Wait(time.Duration) error",
+		"upper(string) string",
+	}, sigs)
+}
+
+func TestDispatcher_Register(t *testing.T) {
+	d := newCalculator(t)
+
+	err := d.Register("", &Calculator{})
+	assert.ErrorIs(t, err, ErrAlreadyRegistered)
+	assert.EqualError(t, err, "already registered: Calculator.Add")
+
+	assert.NoError(t, d.Register("calc", &Calculator{}))
+	out, err := d.Call(context.Background(), "calc.Add", "2", "2")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, out)
+
+	// the methods of *Calculator aren't in the method set of Calculator.
+	err = d.Register("", Calculator{})
+	assert.ErrorIs(t, err, ErrUnsupportedType)
+	assert.EqualError(t, err, "unsupported type: main.Calculator has no methods to dispatch")
+
+	err = d.RegisterFunc("pair", func() (int, int) { return 1, 2 })
+	assert.EqualError(t, err, "unsupported type: func() (int, int) can't be dispatched")
+	err = d.RegisterFunc("nil", nil)
+	assert.EqualError(t, err, "unsupported type: <nil> isn't a func")
+
+	assert.ErrorIs(t, d.Register("nil", nil), ErrNilPtr)
+	assert.ErrorIs(t, d.Register("nil", (*Calculator)(nil)), ErrNilPtr)
+}
+
+// runCLI reads the commands from in and writes the results to out:
+//
+//	help                  lists the methods
+//	Name arg1 arg2 ...    calls Name with the arguments as strings
+//	Name [json, args]     calls Name with the arguments as JSON
+func runCLI(ctx context.Context, d *Dispatcher, in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "help" {
+			for _, sig := range d.Methods() {
+				fmt.Fprintln(out, sig)
+			}
+			continue
+		}
+
+		var result any
+		var err error
+		name, rest, _ := strings.Cut(line, " ")
+		if rest = strings.TrimSpace(rest); strings.HasPrefix(rest, "[") {
+			result, err = d.CallJSON(ctx, name, []byte(rest))
+		} else {
+			result, err = d.Call(ctx, name, strings.Fields(rest)...)
+		}
+
+		switch {
+		case err != nil:
+			fmt.Fprintln(out, "error:", err)
+		case result == nil:
+			fmt.Fprintln(out, "ok")
+		default:
+			data, err := json.Marshal(result)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(out, string(data))
+		}
+	}
+	return scanner.Err()
+}
+
+func TestDispatcher_CLI(t *testing.T) {
+	d := newCalculator(t)
+	in := strings.NewReader(`
+help
+Calculator.Add 40 2
+Calculator.Sum 1 2 3.5
+Calculator.Scale [{"X": 1, "Y": 1}, 5]
+Calculator.Store 7
+Calculator.Recall
+Calculator.Div 1 0
+upper go
+Calculator.Pow 2 8
+`)
+
+	var out strings.Builder
+	assert.NoError(t, runCLI(context.Background(), d, in, &out))
+	assert.Equal(t, `Calculator.Add(int, int) int
+Calculator.Div(float64, float64) (float64, error)
+Calculator.Join(string, ...string) string
+Calculator.Recall() float64
+Calculator.Scale(main.Point, int) main.Point
+Calculator.Store(float64)
+Calculator.Sum(...float64) float64
+Calculator.Wait(time.Duration) error
+upper(string) string
+42
+6.5
+{"X":5,"Y":5}
+ok
+7
+error: division by zero
+"GO"
+error: unknown method: Calculator.Pow
+`, out.String())
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"cmp"
+	"encoding"
 	"errors"
 	"fmt"
 	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
-// go test -v homework_test.go
+// go test -v .
 
 type Person struct {
 	Name    string `properties:"name"`
@@ -27,8 +33,12 @@ func Serialize(person Person) string {
 const (
 	propsTag = "properties"
 
-	propsTokenIgnore = "-"
-	propsTokenOmit   = "omitempty"
+	propsTokenIgnore  = "-"
+	propsTokenOmit    = "omitempty"
+	propsTokenString  = "string"
+	propsTokenInline  = "inline"
+	propsTokenRequire = "required"
+	propsTokenDefault = "default="
 
 	propsTokenSep = ","
 	propsNameSep  = "."
@@ -38,17 +48,24 @@ const (
 )
 
 var (
-	ErrNilPtr         = errors.New("nil pointer")
-	ErrNotAStruct     = errors.New("not a struct")
-	ErrInvalidToken   = errors.New("invalid token")
-	ErrNotImplemented = errors.New("not implemented")
+	ErrNilPtr          = errors.New("nil pointer")
+	ErrNotAStruct      = errors.New("not a struct")
+	ErrInvalidToken    = errors.New("invalid token")
+	ErrUnsupportedType = errors.New("unsupported type")
 )
 
-func Marshal(in any) (out []byte, err error) {
-	return marshal("", in)
-}
+var durationType = reflect.TypeFor[time.Duration]()
 
-func marshal(prefix string, in any) (out []byte, err error) {
+// Marshal writes the exported fields of the struct in as name=value rows.
+// Nested structs and maps are flattened with dotted names (embedded.str=...,
+// labels.env=...), map keys are sorted. Slices of simple values are written
+// as a single comma separated row, slices of structs, slices and maps as
+// indexed rows (items.0.name=...). Nil pointers, interfaces and maps are
+// skipped, interfaces are written by their dynamic value. time.Time is
+// written in RFC 3339 format. The types implementing PropertiesMarshaler or
+// encoding.TextMarshaler write themselves, in this order of preference.
+// See planOf for the embedded structs and parseTag for the tag options.
+func Marshal(in any) (out []byte, err error) {
 	v, ok := deref(reflect.ValueOf(in))
 	if !ok {
 		return nil, ErrNilPtr
@@ -56,91 +73,365 @@ func marshal(prefix string, in any) (out []byte, err error) {
 	if v.Kind() != reflect.Struct {
 		return nil, ErrNotAStruct
 	}
+	return marshal(nil, "", v)
+}
 
-	var name string
-	for i := 0; ; i++ { // while do
-		fldval := v.Field(i)
-		fldtyp := reflect.TypeOf(in).Field(i)
+func marshal(out []byte, prefix string, v reflect.Value) ([]byte, error) {
+	fields, err := planOf(v.Type())
+	if err != nil {
+		return nil, err
+	}
 
-		if tag, ok := fldtyp.Tag.Lookup(propsTag); !ok {
-			name = strings.ToLower(fldtyp.Name)
-		} else {
-			tokens := strings.Split(tag, propsTokenSep)
-			if len(tokens) == 0 || len(tokens) > 2 {
-				return nil, ErrInvalidToken
-			}
+	for _, f := range fields {
+		fldval, err := field(v, f.index, false)
+		if err != nil || !fldval.IsValid() {
+			continue // a nil embedded pointer.
+		}
+		if f.omitempty && fldval.IsZero() {
+			continue
+		}
 
-			if len(tokens) == 2 {
-				switch tokens[1] {
-				case propsTokenIgnore:
-					continue
-				case propsTokenOmit:
-					if fldval.IsZero() {
-						continue
-					}
-				default:
-					return nil, ErrInvalidToken
+		switch elm, ok := deref(fldval); {
+		case f.inline:
+			out, err = marshalValue(out, prefix, fldval)
+		case f.quoted && ok:
+			out = mkrow(out, join(prefix, f.name), escapeValue(strconv.Quote(v2s(elm))))
+		default:
+			out, err = marshalValue(out, join(prefix, f.name), fldval)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// field returns the field of the struct v at index, following the pointers
+// of the embedded structs. A nil pointer gives an invalid value, unless
+// alloc is set and it is allocated.
+func field(v reflect.Value, index []int, alloc bool) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc {
+					return reflect.Value{}, nil
 				}
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("%w to unexported embedded %s", ErrNilPtr, v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
 			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
 
-			if name = tokens[0]; prefix != "" {
-				name = fmt.Sprint(prefix, propsNameSep, name)
-			}
+// fieldPlan is a field of a struct to encode, see planOf.
+type fieldPlan struct {
+	index      []int // see reflect.Value.FieldByIndex.
+	name       string
+	tagged     bool // the name is set by the tag.
+	omitempty  bool
+	quoted     bool   // the string option, only for simple values.
+	inline     bool   // a map whose entries are written at the parent level.
+	required   bool   // see Loader.
+	usage      string // the help of the flag, see Loader.
+	def        string
+	hasDefault bool
+}
+
+type structPlan struct {
+	fields []fieldPlan
+	err    error
+}
+
+// plans caches the structPlan of every struct type met, so the tags are
+// parsed once per type and not on every call.
+var plans sync.Map // reflect.Type -> *structPlan
+
+// planOf returns the fields of the struct type t that are written, in the
+// order of declaration. Like encoding/json, the fields of the anonymous
+// embedded structs without a tag name and of the inline structs are
+// promoted to t. When several fields have the same name, the least nested
+// one wins, then the tagged one, otherwise they are all ignored.
+func planOf(t reflect.Type) ([]fieldPlan, error) {
+	p, ok := plans.Load(t)
+	if !ok {
+		p, _ = plans.LoadOrStore(t, buildPlan(t))
+	}
+	plan := p.(*structPlan)
+	return plan.fields, plan.err
+}
+
+func buildPlan(t reflect.Type) *structPlan {
+	var fields []fieldPlan
+	if err := collectFields(t, nil, map[reflect.Type]bool{t: true}, &fields); err != nil {
+		return &structPlan{err: err}
+	}
+
+	byName := make(map[string][]int) // the positions in fields.
+	for i, f := range fields {
+		byName[f.name] = append(byName[f.name], i)
+	}
+
+	result := fields[:0:0]
+	for i, f := range fields {
+		if dominant(fields, byName[f.name]) == i {
+			result = append(result, f)
 		}
+	}
+	return &structPlan{fields: result}
+}
+
+// dominant returns the position of the field that wins among the ones with
+// the same name, or -1.
+func dominant(fields []fieldPlan, candidates []int) int {
+	depth := len(fields[candidates[0]].index)
+	for _, i := range candidates {
+		depth = min(depth, len(fields[i].index))
+	}
 
-		if fldval, ok = deref(fldval); !ok {
+	var top, tagged []int
+	for _, i := range candidates {
+		if len(fields[i].index) != depth {
 			continue
 		}
+		if top = append(top, i); fields[i].tagged {
+			tagged = append(tagged, i)
+		}
+	}
 
-		var row []byte
-		switch fldval.Kind() {
-		case reflect.Struct:
-			if row, err = marshal(name, fldval.Interface()); err != nil {
-				return nil, err
+	switch {
+	case len(top) == 1:
+		return top[0]
+	case len(tagged) == 1:
+		return tagged[0]
+	}
+	return -1
+}
+
+// collectFields appends the fields of t nested at index to fields. The
+// visited structs stop the embedding cycles made with pointers.
+func collectFields(t reflect.Type, index []int, visited map[reflect.Type]bool, fields *[]fieldPlan) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		typ := f.Type
+		if typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		if !f.IsExported() && !(f.Anonymous && typ.Kind() == reflect.Struct) {
+			continue // the exported fields of unexported embedded structs are promoted.
+		}
+
+		plan, ignore, err := parseTag(f)
+		if err != nil {
+			return err
+		}
+		if ignore {
+			continue
+		}
+		plan.index = append(slices.Clip(index), i)
+
+		if typ.Kind() == reflect.Struct && ((f.Anonymous && !plan.tagged) || plan.inline) {
+			if visited[typ] {
+				continue
 			}
-		case reflect.Array, reflect.Slice:
-			elms := make([]string, fldval.Len())
-			for j := 0; j < fldval.Len(); j++ {
-				elm := fldval.Index(j)
-				if elm, ok = deref(elm); !ok {
-					continue
-				}
-				if elm.Kind() == reflect.Struct ||
-					elm.Kind() == reflect.Array ||
-					elm.Kind() == reflect.Slice ||
-					elm.Kind() == reflect.Map ||
-					elm.Kind() == reflect.Interface {
-					panic(ErrNotImplemented)
-				}
-				elms[j] = v2s(elm)
+			visited[typ] = true
+			err := collectFields(typ, plan.index, visited, fields)
+			delete(visited, typ)
+			if err != nil {
+				return err
 			}
-			row = mkrow(name, strings.Join(elms, propsElemsSep))
-		case reflect.Map, reflect.Interface:
-			panic(ErrNotImplemented)
-		default: // simple types: string, int, bool, etc...
-			row = mkrow(name, v2s(fldval))
+			continue
+		}
+		if !f.IsExported() {
+			continue
 		}
 
-		out = append(out, row...)
-		if i == v.NumField()-1 {
+		if plan.inline && typ.Kind() != reflect.Map {
+			return fmt.Errorf("field %s: %w: %s can't be inline", f.Name, ErrInvalidToken, f.Type)
+		}
+		if plan.inline {
+			plan.name = "" // entries of the map.
+		}
+		if typ.Kind() == reflect.Ptr || !simple(typ.Kind()) || implementsType(typ, textMarshalerType) {
+			plan.quoted = false
+		}
+		*fields = append(*fields, plan)
+	}
+	return nil
+}
+
+// parseTag parses the properties tag of the field:
+//
+//	properties:"name,omitempty,string,inline,required,default=value"
+//
+// All the parts are optional, the name is the lower case field name by
+// default. The "-" tag ignores the field, while "-," names it "-". The
+// default value, that Unmarshal sets when there are no rows for the field,
+// must be the last option, since it may contain commas. The legacy
+// "name,-" form ignores the field as well.
+func parseTag(f reflect.StructField) (plan fieldPlan, ignore bool, err error) {
+	plan.name = strings.ToLower(f.Name)
+	plan.usage = f.Tag.Get("usage")
+
+	tag, ok := f.Tag.Lookup(propsTag)
+	if !ok {
+		return plan, false, nil
+	}
+	if tag == propsTokenIgnore {
+		return plan, true, nil
+	}
+
+	name, opts, _ := strings.Cut(tag, propsTokenSep)
+	if name != "" {
+		plan.name, plan.tagged = name, true
+	}
+
+	for opts != "" {
+		if def, ok := strings.CutPrefix(opts, propsTokenDefault); ok {
+			plan.def, plan.hasDefault = def, true
 			break
 		}
-		out = append(out, propsRowSep)
+
+		var opt string
+		opt, opts, _ = strings.Cut(opts, propsTokenSep)
+		switch opt {
+		case propsTokenIgnore:
+			return plan, true, nil
+		case propsTokenOmit:
+			plan.omitempty = true
+		case propsTokenString:
+			plan.quoted = true
+		case propsTokenInline:
+			plan.inline = true
+		case propsTokenRequire:
+			plan.required = true
+		default:
+			return plan, false, fmt.Errorf("field %s: %w %q", f.Name, ErrInvalidToken, opt)
+		}
 	}
-	return out, nil
+	return plan, false, nil
 }
 
-func deref(v reflect.Value) (reflect.Value, bool) {
-	if v.Kind() != reflect.Ptr {
-		return v, true
+func marshalValue(out []byte, name string, v reflect.Value) ([]byte, error) {
+	v, ok := deref(v)
+	if !ok {
+		return out, nil
 	}
 
-	for ; v.Kind() == reflect.Ptr; v = v.Elem() {
+	if m, ok := implements[PropertiesMarshaler](v); ok {
+		return marshalRows(out, name, m)
+	}
+	if m, ok := implements[encoding.TextMarshaler](v); ok {
+		text, err := m.MarshalText()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return mkrow(out, name, escapeValue(string(text))), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		return marshal(out, name, v)
+	case reflect.Map:
+		if !writtenAsScalar(v.Type().Key()) {
+			return nil, fmt.Errorf("%w: %s key of %s", ErrUnsupportedType, v.Type().Key(), name)
+		}
+
+		entries := make([]mapEntry, 0, v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			key, err := text(iter.Key())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			entries = append(entries, mapEntry{key: iter.Key(), name: key, value: iter.Value()})
+		}
+		slices.SortFunc(entries, compareEntries)
+
+		var err error
+		for _, e := range entries {
+			if out, err = marshalValue(out, join(name, e.name), e.value); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case reflect.Array, reflect.Slice:
+		if !writtenAsScalar(v.Type().Elem()) {
+			var err error
+			for j := 0; j < v.Len(); j++ {
+				if out, err = marshalValue(out, join(name, strconv.Itoa(j)), v.Index(j)); err != nil {
+					return nil, err
+				}
+			}
+			return out, nil
+		}
+
+		elms := make([]string, v.Len())
+		for j := 0; j < v.Len(); j++ {
+			elm, ok := deref(v.Index(j))
+			if !ok {
+				continue
+			}
+			s, err := text(elm)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", join(name, strconv.Itoa(j)), err)
+			}
+			elms[j] = escape(s, propsElemsSep)
+		}
+		return mkrow(out, name, escapeLeading(strings.Join(elms, propsElemsSep))), nil
+	default:
+		if !simple(v.Kind()) {
+			return nil, fmt.Errorf("%w: %s of %s", ErrUnsupportedType, v.Type(), name)
+		}
+		return mkrow(out, name, escapeValue(v2s(v))), nil
+	}
+}
+
+// deref follows pointers and interfaces to the value they point to, false
+// means that a nil one has been met.
+func deref(v reflect.Value) (reflect.Value, bool) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
 		if v.IsNil() {
 			return v, false
 		}
+		v = v.Elem()
 	}
-	return v, true
+	return v, v.IsValid()
+}
+
+// simple reports whether the values of kind k are written as a single value.
+func simple(k reflect.Kind) bool {
+	switch k {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return true
+	}
+	return false
+}
+
+type mapEntry struct {
+	key   reflect.Value
+	name  string // the key as it is written.
+	value reflect.Value
+}
+
+// compareEntries orders map entries: numbers by value, the rest by name.
+func compareEntries(a, b mapEntry) int {
+	switch a.key.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmp.Compare(a.key.Int(), b.key.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return cmp.Compare(a.key.Uint(), b.key.Uint())
+	case reflect.Float32, reflect.Float64:
+		return cmp.Compare(a.key.Float(), b.key.Float())
+	}
+	return strings.Compare(a.name, b.name)
 }
 
 func v2s(v reflect.Value) string {
@@ -150,12 +441,23 @@ func v2s(v reflect.Value) string {
 	return fmt.Sprintf("%v", v.Interface())
 }
 
-func mkrow(name, value string) []byte {
-	row := make([]byte, 0, len(name)+1+len(value))
-	row = append(row, name...)
-	row = append(row, propsKVSep)
-	row = append(row, value...)
-	return row
+func join(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + propsNameSep + name
+}
+
+// mkrow appends the name=value row to out, separated from the previous one.
+// The value must be escaped already, see escapeValue.
+func mkrow(out []byte, name, value string) []byte {
+	if len(out) > 0 {
+		out = append(out, propsRowSep)
+	}
+	out = append(out, escapeKey(name)...)
+	out = append(out, propsKVSep)
+	out = append(out, value...)
+	return out
 }
 
 func TestSerialization(t *testing.T) {
@@ -353,16 +655,130 @@ func TestMarshal(t *testing.T) {
 			},
 			want: "str=lvl1\nembedded.str=lvl2\nembedded.embedded.str=lvl3\nembedded.embedded.embedded.str=lvl4",
 		},
+		{
+			name: "map",
+			in: struct {
+				Labels map[string]string `properties:"labels"`
+				Ports  map[int]bool      `properties:"ports"`
+				Limits map[string]struct {
+					CPU int `properties:"cpu"`
+				} `properties:"limits"`
+				Empty map[string]int `properties:"empty"`
+			}{
+				Labels: map[string]string{"env": "prod", "app": "api", "zone": "eu"},
+				Ports:  map[int]bool{8080: true, 443: true, 80: false},
+				Limits: map[string]struct {
+					CPU int `properties:"cpu"`
+				}{"worker": {CPU: 4}, "api": {CPU: 2}},
+			},
+			want: "labels.app=api\nlabels.env=prod\nlabels.zone=eu\n" +
+				"ports.80=false\nports.443=true\nports.8080=true\n" +
+				"limits.api.cpu=2\nlimits.worker.cpu=4",
+		},
+		{
+			name: "interface",
+			in: struct {
+				Value    any          `properties:"value"`
+				Ptr      any          `properties:"ptr"`
+				Nested   any          `properties:"nested"`
+				Nil      any          `properties:"nil"`
+				Stringer fmt.Stringer `properties:"stringer"`
+			}{
+				Value:    42,
+				Ptr:      ptr("string"),
+				Nested:   Person{Name: "John Doe", Age: 30},
+				Stringer: ptr(reflect.Int),
+			},
+			want: "value=42\nptr=string\nnested.name=John Doe\nnested.age=30\nnested.married=false\nstringer=int",
+		},
+		{
+			name: "slice of structs",
+			in: struct {
+				Items []*Person        `properties:"items"`
+				Grid  [][]int          `properties:"grid"`
+				Any   []any            `properties:"any"`
+				Maps  []map[string]int `properties:"maps"`
+			}{
+				Items: []*Person{{Name: "John", Age: 30}, nil, {Name: "Jane", Address: "Paris", Married: true}},
+				Grid:  [][]int{{1, 2}, {3}},
+				Any:   []any{"one", 2},
+				Maps:  []map[string]int{{"b": 2, "a": 1}},
+			},
+			want: "items.0.name=John\nitems.0.age=30\nitems.0.married=false\n" +
+				"items.2.name=Jane\nitems.2.address=Paris\nitems.2.age=0\nitems.2.married=true\n" +
+				"grid.0=1,2\ngrid.1=3\nany.0=one\nany.1=2\nmaps.0.a=1\nmaps.0.b=2",
+		},
+		{
+			name: "untagged and unexported fields",
+			in: struct {
+				Nested struct {
+					Name    string
+					private int
+				} `properties:"nested"`
+				Last int `properties:"last,omitempty"`
+			}{
+				Nested: struct {
+					Name    string
+					private int
+				}{Name: "name", private: 1},
+			},
+			want: "nested.name=name",
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, _ := Marshal(tt.in)
+			got, err := Marshal(tt.in)
+			assert.NoError(t, err)
 			assert.Equal(t, tt.want, string(got))
 		})
 	}
 }
 
+func TestMarshal_Errors(t *testing.T) {
+	tests := map[string]struct {
+		in  any
+		err error
+	}{
+		"nil":        {in: (*Person)(nil), err: ErrNilPtr},
+		"not struct": {in: 42, err: ErrNotAStruct},
+		"invalid token": {
+			in: struct {
+				Str string `properties:"str,optional"`
+			}{},
+			err: ErrInvalidToken,
+		},
+		"chan": {
+			in: struct {
+				Ch chan int `properties:"ch"`
+			}{Ch: make(chan int)},
+			err: ErrUnsupportedType,
+		},
+		"func in slice": {
+			in: struct {
+				Hooks []func() `properties:"hooks"`
+			}{Hooks: []func(){func() {}}},
+			err: ErrUnsupportedType,
+		},
+		"struct map key": {
+			in: struct {
+				Points map[struct{ X, Y int }]string `properties:"points"`
+			}{Points: map[struct{ X, Y int }]string{{1, 2}: "a"}},
+			err: ErrUnsupportedType,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.NotPanics(t, func() {
+				out, err := Marshal(test.in)
+				assert.ErrorIs(t, err, test.err)
+				assert.Nil(t, out)
+			})
+		})
+	}
+}
+
 func ptr[T any](v T) *T {
 	return &v
 }
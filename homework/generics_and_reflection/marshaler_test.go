@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v -run 'Marshaler|Plan' -bench . .
+
+// PropertiesMarshaler is implemented by the types that write their own
+// rows. The names are relative to the name of the value, the "" name is
+// the value itself.
+type PropertiesMarshaler interface {
+	MarshalProperties() (map[string]string, error)
+}
+
+// PropertiesUnmarshaler is implemented by the types that read their own
+// rows, see PropertiesMarshaler. The values are unescaped already.
+type PropertiesUnmarshaler interface {
+	UnmarshalProperties(rows map[string]string) error
+}
+
+var (
+	propertiesMarshalerType   = reflect.TypeFor[PropertiesMarshaler]()
+	propertiesUnmarshalerType = reflect.TypeFor[PropertiesUnmarshaler]()
+	textMarshalerType         = reflect.TypeFor[encoding.TextMarshaler]()
+	textUnmarshalerType       = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// implements returns v as T if v or a pointer to it implements T. For the
+// pointer receivers an unaddressable v is copied.
+func implements[T any](v reflect.Value) (T, bool) {
+	if t, ok := v.Interface().(T); ok {
+		return t, true
+	}
+
+	if !reflect.PointerTo(v.Type()).Implements(reflect.TypeFor[T]()) {
+		var zero T
+		return zero, false
+	}
+	if !v.CanAddr() {
+		cp := reflect.New(v.Type())
+		cp.Elem().Set(v)
+		return cp.Interface().(T), true
+	}
+	return v.Addr().Interface().(T), true
+}
+
+func implementsType(t, iface reflect.Type) bool {
+	return t.Implements(iface) || reflect.PointerTo(t).Implements(iface)
+}
+
+// writtenAsScalar reports whether the values of type t are written as a
+// single value, that can be an element of a list or a map key.
+func writtenAsScalar(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if implementsType(t, propertiesMarshalerType) {
+		return false
+	}
+	return implementsType(t, textMarshalerType) || simple(t.Kind())
+}
+
+// readAsScalar is writtenAsScalar for Unmarshal.
+func readAsScalar(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if implementsType(t, propertiesUnmarshalerType) {
+		return false
+	}
+	return implementsType(t, textUnmarshalerType) || simple(t.Kind())
+}
+
+// text returns the written form of a scalar, see writtenAsScalar.
+func text(v reflect.Value) (string, error) {
+	if m, ok := implements[encoding.TextMarshaler](v); ok {
+		b, err := m.MarshalText()
+		return string(b), err
+	}
+	return v2s(v), nil
+}
+
+func marshalRows(out []byte, name string, m PropertiesMarshaler) ([]byte, error) {
+	rows, err := m.MarshalProperties()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(rows)) {
+		row := name
+		if k != "" {
+			row = join(name, k)
+		}
+		out = mkrow(out, row, escapeValue(rows[k]))
+	}
+	return out, nil
+}
+
+// UserID is written as "u-42".
+type UserID int64
+
+func (id UserID) MarshalText() ([]byte, error) {
+	return []byte("u-" + strconv.FormatInt(int64(id), 10)), nil
+}
+
+func (id *UserID) UnmarshalText(text []byte) error {
+	s, ok := strings.CutPrefix(string(text), "u-")
+	if !ok {
+		return fmt.Errorf("invalid user id %q", text)
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	*id = UserID(n)
+	return err
+}
+
+// Headers are written one row per header, like http.Header.
+type Headers map[string][]string
+
+func (h Headers) MarshalProperties() (map[string]string, error) {
+	rows := make(map[string]string, len(h))
+	for k, v := range h {
+		rows[strings.ToLower(k)] = strings.Join(v, "; ")
+	}
+	return rows, nil
+}
+
+func (h *Headers) UnmarshalProperties(rows map[string]string) error {
+	if _, ok := rows[""]; ok {
+		return errors.New("header name is missing")
+	}
+	*h = make(Headers, len(rows))
+	for k, v := range rows {
+		(*h)[k] = strings.Split(v, "; ")
+	}
+	return nil
+}
+
+// Version implements both interfaces, PropertiesMarshaler wins.
+type Version struct {
+	Major, Minor int
+}
+
+func (v Version) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "%d.%d", v.Major, v.Minor), nil
+}
+
+func (v Version) MarshalProperties() (map[string]string, error) {
+	if v.Major < 0 {
+		return nil, errors.New("negative version")
+	}
+	return map[string]string{"": fmt.Sprintf("v%d.%d", v.Major, v.Minor), "major": strconv.Itoa(v.Major)}, nil
+}
+
+type Service struct {
+	Owner    UserID            `properties:"owner"`
+	Admins   []UserID          `properties:"admins"`
+	Quotas   map[UserID]int    `properties:"quotas"`
+	Addr     net.IP            `properties:"addr"`
+	Peers    []net.IP          `properties:"peers"`
+	Headers  Headers           `properties:"headers"`
+	Version  Version           `properties:"version"`
+	Deadline time.Time         `properties:"deadline"`
+	Aliases  map[string]UserID `properties:"aliases"`
+}
+
+func TestMarshaler(t *testing.T) {
+	in := Service{
+		Owner:    42,
+		Admins:   []UserID{1, 2},
+		Quotas:   map[UserID]int{10: 1, 2: 2},
+		Addr:     net.ParseIP("10.0.0.1"),
+		Peers:    []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("::1")},
+		Headers:  Headers{"Accept": {"text/plain", "q=0.5"}, "X-Id": {"1"}},
+		Version:  Version{Major: 1, Minor: 2},
+		Deadline: time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		Aliases:  map[string]UserID{"root": 0},
+	}
+
+	data, err := Marshal(in)
+	assert.NoError(t, err)
+	assert.Equal(t, "owner=u-42\n"+
+		"admins=u-1,u-2\n"+
+		"quotas.u-2=2\n"+
+		"quotas.u-10=1\n"+
+		"addr=10.0.0.1\n"+
+		"peers=10.0.0.2,::1\n"+
+		"headers.accept=text/plain; q=0.5\n"+
+		"headers.x-id=1\n"+
+		"version=v1.2\n"+
+		"version.major=1\n"+
+		"deadline=2024-03-01T12:30:00Z\n"+
+		"aliases.root=u-0", string(data))
+
+	// Version doesn't implement PropertiesUnmarshaler, its rows are read by
+	// reflection: the version row is ignored and the minor one is missing.
+	var out Service
+	assert.NoError(t, Unmarshal(data, &out))
+	assert.Equal(t, Version{Major: 1}, out.Version)
+
+	data, err = Marshal(struct {
+		Service `properties:"service"`
+	}{Service: Service{Owner: 1, Version: Version{Major: -1}}})
+	assert.EqualError(t, err, "service.version: negative version")
+	assert.Nil(t, data)
+}
+
+func TestUnmarshaler(t *testing.T) {
+	data := "owner=u-42\n" +
+		"admins=u-1,u-2\n" +
+		"quotas.u-10=1\n" +
+		"addr=10.0.0.1\n" +
+		"peers=10.0.0.2,::1\n" +
+		"headers.accept=text/plain; q=0.5\n" +
+		"deadline=2024-03-01T12:30:00Z\n" +
+		"aliases.root.user=u-0\n"
+
+	var out Service
+	assert.NoError(t, Unmarshal([]byte(data), &out))
+	assert.Equal(t, UserID(42), out.Owner)
+	assert.Equal(t, []UserID{1, 2}, out.Admins)
+	assert.Equal(t, map[UserID]int{10: 1}, out.Quotas)
+	assert.True(t, out.Addr.Equal(net.ParseIP("10.0.0.1")))
+	assert.Len(t, out.Peers, 2)
+	assert.Equal(t, Headers{"accept": {"text/plain", "q=0.5"}}, out.Headers)
+	assert.Equal(t, time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC), out.Deadline)
+	assert.Equal(t, map[string]UserID{"root.user": 0}, out.Aliases)
+
+	tests := map[string]string{
+		"owner=42":          `line 1: owner: invalid user id "42"`,
+		"admins=u-1,2":      `line 1: admins.1: invalid user id "2"`,
+		"quotas.7=1":        `line 1: quotas.7: invalid key: invalid user id "7"`,
+		"headers=all":       "line 1: headers: header name is missing",
+		"\n\naddr=10.0.0.x": "line 3: addr: invalid IP address: 10.0.0.x",
+	}
+	for data, msg := range tests {
+		t.Run(data, func(t *testing.T) {
+			var out Service
+			assert.EqualError(t, Unmarshal([]byte(data), &out), msg)
+		})
+	}
+}
+
+func TestMarshaler_RoundTrip(t *testing.T) {
+	type Holder struct {
+		ID      UserID   `properties:"id"`
+		IDPtr   *UserID  `properties:"idPtr"`
+		IDs     []UserID `properties:"ids"`
+		Headers Headers  `properties:"headers"`
+	}
+
+	in := Holder{ID: 1, IDPtr: ptr(UserID(2)), IDs: []UserID{3, 4}, Headers: Headers{"a": {"1", "2"}}}
+	data, err := Marshal(in)
+	assert.NoError(t, err)
+
+	var out Holder
+	assert.NoError(t, Unmarshal(data, &out))
+	assert.Equal(t, in, out)
+}
+
+func TestPlan(t *testing.T) {
+	typ := reflect.TypeFor[Person]()
+	fields, err := planOf(typ)
+	assert.NoError(t, err)
+	assert.Equal(t, []fieldPlan{
+		{index: []int{0}, name: "name", tagged: true},
+		{index: []int{1}, name: "address", tagged: true, omitempty: true},
+		{index: []int{2}, name: "age", tagged: true},
+		{index: []int{3}, name: "married", tagged: true},
+	}, fields)
+
+	cached, _ := plans.Load(typ)
+	again, _ := planOf(typ)
+	assert.Same(t, &cached.(*structPlan).fields[0], &again[0])
+
+	type invalid struct {
+		Str string `properties:"str,optional"`
+	}
+	for range 2 { // the error is cached too.
+		_, err := planOf(reflect.TypeFor[invalid]())
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	}
+}
+
+var benchConfig = Config{
+	Name:     "api",
+	Debug:    ptr(true),
+	Ratio:    0.75,
+	Timeout:  90 * time.Second,
+	Started:  time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+	Tags:     []string{"a", "b", "c"},
+	Weights:  [3]int8{1, 2, 3},
+	Primary:  &Endpoint{Host: "localhost", Port: 8080},
+	Replicas: []Endpoint{{Host: "first", Port: 1}, {Host: "second", Port: 2}},
+	Labels:   map[string]string{"app": "api", "env": "prod"},
+	Limits:   map[string]*Endpoint{"cpu": {Host: "a"}},
+	Grid:     [][]int{{1, 2}, {3}},
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(&benchConfig); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	data, _ := Marshal(&benchConfig)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var c Config
+		if err := Unmarshal(data, &c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkMarshal_JSON is the baseline.
+func BenchmarkMarshal_JSON(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(&benchConfig); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPlan(b *testing.B) {
+	typ := reflect.TypeFor[Config]()
+
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			planOf(typ)
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buildPlan(typ)
+		}
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v -run 'Embedded|Tag|Inline|Default' .
+
+type (
+	Base struct {
+		ID   int    `properties:"id"`
+		Kind string `properties:"kind"`
+	}
+
+	Audit struct {
+		Created time.Time `properties:"created"`
+		Author  string    `properties:"author"`
+		Kind    string    // untagged, hidden by Base.Kind.
+	}
+
+	timestamps struct {
+		Updated int64 `properties:"updated"`
+	}
+
+	Document struct {
+		Base
+		*Audit
+		timestamps
+		Title string `properties:"title"`
+		Owner Base   `properties:"owner"`
+		Named Base   `properties:"named,inline"`
+	}
+)
+
+func TestEmbedded(t *testing.T) {
+	doc := Document{
+		Base:       Base{ID: 1, Kind: "note"},
+		Audit:      &Audit{Created: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), Author: "john", Kind: "hidden"},
+		timestamps: timestamps{Updated: 100},
+		Title:      "todo",
+		Owner:      Base{ID: 2, Kind: "user"},
+	}
+
+	// Named is inline too: its fields are as deep as the ones of Base, so
+	// the names conflict and all of them are dropped.
+	data, err := Marshal(doc)
+	assert.NoError(t, err)
+	assert.Equal(t, "created=2024-03-01T00:00:00Z\nauthor=john\nupdated=100\ntitle=todo\nowner.id=2\nowner.kind=user", string(data))
+
+	var out Document
+	assert.NoError(t, Unmarshal(data, &out))
+	doc.Base, doc.Audit.Kind = Base{}, ""
+	assert.Equal(t, doc, out)
+
+	// a nil embedded pointer is skipped, and allocated if it has rows.
+	data, err = Marshal(Document{Title: "todo"})
+	assert.NoError(t, err)
+	assert.Equal(t, "updated=0\ntitle=todo\nowner.id=0\nowner.kind=", string(data))
+
+	out = Document{}
+	assert.NoError(t, Unmarshal([]byte("title=todo"), &out))
+	assert.Nil(t, out.Audit)
+	assert.NoError(t, Unmarshal([]byte("author=jane"), &out))
+	assert.Equal(t, &Audit{Author: "jane"}, out.Audit)
+}
+
+func TestEmbedded_Dominance(t *testing.T) {
+	type Inner struct {
+		Name  string `properties:"name"`
+		Level int
+	}
+	type Tagged struct {
+		Value string `properties:"level"`
+	}
+	type Outer struct {
+		Inner
+		Tagged
+		Name string `properties:"name"`
+	}
+
+	data, err := Marshal(Outer{Inner: Inner{Name: "inner", Level: 1}, Tagged: Tagged{Value: "tagged"}, Name: "outer"})
+	assert.NoError(t, err)
+	assert.Equal(t, "level=tagged\nname=outer", string(data))
+
+	// a tagged embedded struct is a named field.
+	type Prefixed struct {
+		Inner `properties:"inner"`
+	}
+	data, err = Marshal(Prefixed{Inner{Name: "inner"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "inner.name=inner\ninner.level=0", string(data))
+
+	// an embedding cycle through pointers stops.
+	type Node struct {
+		*Node
+		Value int `properties:"value"`
+	}
+	data, err = Marshal(Node{Node: &Node{Value: 1}, Value: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, "value=2", string(data))
+}
+
+func TestTag_IgnoreAndString(t *testing.T) {
+	type Options struct {
+		Ignored string   `properties:"-"`
+		Dash    string   `properties:"-,"`
+		Legacy  string   `properties:"legacy,-"`
+		Port    int      `properties:"port,string"`
+		Ratio   *float64 `properties:"ratio,string,omitempty"`
+		Padded  string   `properties:",string"`
+		Tags    []int    `properties:"tags,string"` // ignored for lists, as in encoding/json.
+	}
+
+	in := Options{Ignored: "a", Dash: "b", Legacy: "c", Port: 8080, Ratio: ptr(0.5), Padded: " x ", Tags: []int{1, 2}}
+	data, err := Marshal(in)
+	assert.NoError(t, err)
+	assert.Equal(t, "-=b\nport=\"8080\"\nratio=\"0.5\"\npadded=\" x \"\ntags=1,2", string(data))
+
+	var out Options
+	assert.NoError(t, Unmarshal(data, &out))
+	in.Ignored, in.Legacy = "", ""
+	assert.Equal(t, in, out)
+
+	err = Unmarshal([]byte("port=8080"), &out)
+	assert.ErrorIs(t, err, strconv.ErrSyntax)
+	assert.EqualError(t, err, "line 1: port: quoted value: invalid syntax")
+
+	err = Unmarshal([]byte(`port="http"`), &out)
+	assert.EqualError(t, err, `line 1: port: strconv.ParseInt: parsing "http": invalid syntax`)
+}
+
+func TestTag_Inline(t *testing.T) {
+	type Server struct {
+		Host   string `properties:"host"`
+		Port   int    `properties:"port"`
+		Limits struct {
+			CPU int `properties:"cpu"`
+		} `properties:"limits,inline"`
+		Extra map[string]string `properties:",inline"`
+	}
+	type Config struct {
+		Server Server `properties:"server"`
+	}
+
+	in := Config{Server: Server{Host: "localhost", Port: 80, Extra: map[string]string{"tls": "on", "proxy.url": "http://proxy"}}}
+	in.Server.Limits.CPU = 2
+
+	data, err := Marshal(in)
+	assert.NoError(t, err)
+	assert.Equal(t, "server.host=localhost\nserver.port=80\nserver.cpu=2\nserver.proxy.url=http://proxy\nserver.tls=on", string(data))
+
+	var out Config
+	assert.NoError(t, Unmarshal(data, &out))
+	assert.Equal(t, in, out)
+
+	// the rows of the other fields, nested ones included, aren't extra.
+	out = Config{}
+	assert.NoError(t, Unmarshal([]byte("server.port=1\nserver.cpu=4\nserver.cpu.max=8\nother=1"), &out))
+	assert.Equal(t, 4, out.Server.Limits.CPU)
+	assert.Nil(t, out.Server.Extra)
+
+	type Invalid struct {
+		Port int `properties:"port,inline"`
+	}
+	_, err = Marshal(Invalid{})
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	assert.EqualError(t, err, "field Port: invalid token: int can't be inline")
+}
+
+func TestTag_Default(t *testing.T) {
+	type Defaults struct {
+		Host    string        `properties:"host,default=localhost"`
+		Port    *int          `properties:"port,omitempty,default=8080"`
+		Timeout time.Duration `properties:"timeout,default=30s"`
+		Tags    []string      `properties:"tags,default=a,b\\,c"`
+		Started time.Time     `properties:"started,default=2024-01-01T00:00:00Z"`
+		Note    string        `properties:"note,default="`
+		Plain   string        `properties:"plain"`
+	}
+
+	out := Defaults{Note: "set", Plain: "kept"}
+	assert.NoError(t, Unmarshal([]byte("port=9090\nnote=\n"), &out))
+	assert.Equal(t, Defaults{
+		Host:    "localhost",
+		Port:    ptr(9090),
+		Timeout: 30 * time.Second,
+		Tags:    []string{"a", "b,c"},
+		Started: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Plain:   "kept",
+	}, out)
+
+	type Invalid struct {
+		Port int `properties:"port,default=http"`
+	}
+	err := Unmarshal(nil, &Invalid{})
+	assert.ErrorIs(t, err, strconv.ErrSyntax)
+	assert.EqualError(t, err, `port: default "http": strconv.ParseInt: parsing "http": invalid syntax`)
+}
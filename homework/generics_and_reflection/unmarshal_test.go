@@ -0,0 +1,667 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v -run 'Unmarshal|RoundTrip' .
+
+var ErrNotAPointer = errors.New("not a pointer")
+
+// maxIndex limits the indices of the indexed rows of a slice, so that a
+// single row can't make Unmarshal allocate a huge slice. The indices may
+// have gaps, e.g. for the nil pointers skipped by Marshal.
+const maxIndex = 1 << 16
+
+// ParseError reports the line of the properties data that can't be read.
+type ParseError struct {
+	Line int
+	Key  string // empty for syntax errors.
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: %s: %v", e.Line, e.Key, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+type prop struct {
+	raw   string // still escaped, lists are split before unescaping.
+	value string
+	line  int
+}
+
+// props are the parsed name=value rows, the last row wins for duplicate names.
+type props map[string]prop
+
+// nested returns the rest of the row name k nested in name, every row is
+// nested in the empty name.
+func nested(k, name string) (string, bool) {
+	if name == "" {
+		return k, true
+	}
+	return strings.CutPrefix(k, name+propsNameSep)
+}
+
+// has reports whether there is a row for the name or for its nested names.
+func (p props) has(name string) bool {
+	if _, ok := p[name]; ok {
+		return true
+	}
+	for k := range p {
+		if _, ok := nested(k, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// children returns the sorted names nested in name: the whole rest of the
+// row names if whole is set, otherwise only the next segment.
+func (p props) children(name string, whole bool) []string {
+	var result []string
+	for k := range p {
+		rest, ok := nested(k, name)
+		if !ok {
+			continue
+		}
+		if !whole {
+			rest, _, _ = strings.Cut(rest, propsNameSep)
+		}
+		if !slices.Contains(result, rest) {
+			result = append(result, rest)
+		}
+	}
+	slices.Sort(result)
+	return result
+}
+
+// subtree returns the values of the name, with the "" key, and of its nested
+// names, relative to it.
+func (p props) subtree(name string) map[string]string {
+	rows := make(map[string]string)
+	if row, ok := p[name]; ok {
+		rows[""] = row.value
+	}
+	for k, row := range p {
+		if rest, ok := nested(k, name); ok {
+			rows[rest] = row.value
+		}
+	}
+	return rows
+}
+
+// errorf reports err at the first row of the name or of its nested names.
+func (p props) errorf(name string, format string, args ...any) error {
+	line := p[name].line
+	for k, v := range p {
+		if _, ok := nested(k, name); ok && (line == 0 || v.line < line) {
+			line = v.line
+		}
+	}
+	return &ParseError{Line: line, Key: name, Err: fmt.Errorf(format, args...)}
+}
+
+// Unmarshal reads the rows written by Marshal into the struct pointed by v.
+// Nil pointers, maps and slices are allocated when there are rows for them,
+// the fields without rows are left untouched. Rows that don't match any
+// field are ignored. An empty element of a comma separated list leaves the
+// pointer element nil. See readProps for the syntax.
+func Unmarshal(data []byte, v any) error {
+	rv, err := target(v)
+	if err != nil {
+		return err
+	}
+
+	p, err := readProps(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return unmarshal(p, "", rv)
+}
+
+// target returns the struct pointed by v.
+func target(v any) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr {
+		return rv, ErrNotAPointer
+	}
+	if rv.IsNil() {
+		return rv, ErrNilPtr
+	}
+	if rv.Elem().Kind() != reflect.Struct {
+		return rv, ErrNotAStruct
+	}
+	return rv.Elem(), nil
+}
+
+func unmarshal(p props, prefix string, v reflect.Value) error {
+	fields, err := planOf(v.Type())
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		name, rows := join(prefix, f.name), p
+		switch {
+		case f.inline:
+			name, rows = prefix, p.rest(prefix, fields)
+		case !p.has(name) && f.hasDefault:
+			if err := unmarshalDefault(name, f.def, v, f.index); err != nil {
+				return err
+			}
+			continue
+		}
+		if !rows.has(name) {
+			continue
+		}
+
+		fldval, err := field(v, f.index, true)
+		if err != nil {
+			return rows.errorf(name, "%w", err)
+		}
+		if f.quoted {
+			err = unmarshalQuoted(rows, name, fldval)
+		} else {
+			err = unmarshalValue(rows, name, fldval)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rest returns the rows nested in prefix that don't belong to the fields,
+// for the inline map.
+func (p props) rest(prefix string, fields []fieldPlan) props {
+	rest := make(props)
+	for k, row := range p {
+		name, ok := nested(k, prefix)
+		if !ok {
+			continue
+		}
+		name, _, _ = strings.Cut(name, propsNameSep)
+		if !slices.ContainsFunc(fields, func(f fieldPlan) bool {
+			first, _, _ := strings.Cut(f.name, propsNameSep)
+			return !f.inline && first == name
+		}) {
+			rest[k] = row
+		}
+	}
+	return rest
+}
+
+// unmarshalDefault sets the default value of the field as if it was read
+// from a row.
+func unmarshalDefault(name, def string, v reflect.Value, index []int) error {
+	fldval, err := field(v, index, true)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	value, err := unescape(def)
+	if err == nil {
+		err = unmarshalValue(props{name: {raw: def, value: value}}, name, fldval)
+	}
+	if perr := (*ParseError)(nil); errors.As(err, &perr) {
+		err = perr.Err
+	}
+	if err != nil {
+		return fmt.Errorf("%s: default %q: %w", name, def, err)
+	}
+	return nil
+}
+
+// unmarshalQuoted reads a value written with the string option.
+func unmarshalQuoted(p props, name string, v reflect.Value) error {
+	row, ok := p[name]
+	if !ok {
+		return p.errorf(name, "%w: %s has nested rows", ErrUnsupportedType, v.Type())
+	}
+
+	s, err := strconv.Unquote(row.value)
+	if err == nil {
+		err = setScalar(v, s)
+	} else {
+		err = fmt.Errorf("quoted value: %w", err)
+	}
+	if err != nil {
+		return &ParseError{Line: row.line, Key: name, Err: err}
+	}
+	return nil
+}
+
+func unmarshalValue(p props, name string, v reflect.Value) error {
+	if !p.has(name) {
+		return nil
+	}
+
+	if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
+		if u, ok := implements[PropertiesUnmarshaler](v); ok {
+			if err := u.UnmarshalProperties(p.subtree(name)); err != nil {
+				return p.errorf(name, "%w", err)
+			}
+			return nil
+		}
+		if _, ok := implements[encoding.TextUnmarshaler](v); ok {
+			return unmarshalScalar(p, name, v)
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return unmarshalValue(p, name, v.Elem())
+	case reflect.Interface:
+		switch {
+		case !v.IsNil() && v.Elem().Kind() == reflect.Ptr:
+			return unmarshalValue(p, name, v.Elem())
+		case v.NumMethod() == 0 && v.IsNil():
+			if row, ok := p[name]; ok {
+				v.Set(reflect.ValueOf(row.value))
+				return nil
+			}
+		}
+		return p.errorf(name, "%w: %s", ErrUnsupportedType, v.Type())
+	case reflect.Struct:
+		return unmarshal(p, name, v)
+	case reflect.Map:
+		return unmarshalMap(p, name, v)
+	case reflect.Array, reflect.Slice:
+		if readAsScalar(v.Type().Elem()) {
+			return unmarshalList(p, name, v)
+		}
+		return unmarshalIndexed(p, name, v)
+	default:
+		return unmarshalScalar(p, name, v)
+	}
+}
+
+func unmarshalScalar(p props, name string, v reflect.Value) error {
+	row, ok := p[name]
+	if !ok {
+		return p.errorf(name, "%w: %s has nested rows", ErrUnsupportedType, v.Type())
+	}
+	if err := setScalar(v, row.value); err != nil {
+		return &ParseError{Line: row.line, Key: name, Err: err}
+	}
+	return nil
+}
+
+func unmarshalMap(p props, name string, v reflect.Value) error {
+	typ := v.Type()
+	if !readAsScalar(typ.Key()) {
+		return p.errorf(name, "%w: %s key", ErrUnsupportedType, typ.Key())
+	}
+
+	// the keys of simple values may contain dots, there is nothing nested.
+	keys := p.children(name, readAsScalar(typ.Elem()))
+	if len(keys) == 0 {
+		return nil
+	}
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(typ, len(keys)))
+	}
+
+	for _, k := range keys {
+		key := reflect.New(typ.Key()).Elem()
+		if err := setScalar(key, k); err != nil {
+			return p.errorf(join(name, k), "invalid key: %w", err)
+		}
+
+		elem := reflect.New(typ.Elem()).Elem()
+		if old := v.MapIndex(key); old.IsValid() {
+			elem.Set(old)
+		}
+		if err := unmarshalValue(p, join(name, k), elem); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, elem)
+	}
+	return nil
+}
+
+func unmarshalList(p props, name string, v reflect.Value) error {
+	row, ok := p[name]
+	if !ok {
+		return p.errorf(name, "%w: %s has nested rows", ErrUnsupportedType, v.Type())
+	}
+
+	var elms []string
+	if row.raw != "" {
+		elms = splitList(row.raw)
+	}
+
+	if v.Kind() == reflect.Array {
+		if len(elms) > v.Len() {
+			return &ParseError{Line: row.line, Key: name, Err: fmt.Errorf("%d elements don't fit %s", len(elms), v.Type())}
+		}
+	} else if elms == nil {
+		v.Set(reflect.Zero(v.Type()))
+	} else {
+		v.Set(reflect.MakeSlice(v.Type(), len(elms), len(elms)))
+	}
+
+	for j, raw := range elms {
+		elm, _ := unescape(raw) // already checked by readProps.
+		dst := v.Index(j)
+		if elm == "" && dst.Kind() == reflect.Ptr {
+			continue // Marshal writes nil pointers as empty elements.
+		}
+		if err := setScalar(dst, elm); err != nil {
+			return &ParseError{Line: row.line, Key: join(name, strconv.Itoa(j)), Err: err}
+		}
+	}
+	return nil
+}
+
+func unmarshalIndexed(p props, name string, v reflect.Value) error {
+	var indices []int
+	for _, child := range p.children(name, false) {
+		j, err := strconv.Atoi(child)
+		if err != nil || j < 0 {
+			return p.errorf(join(name, child), "invalid index")
+		}
+		if v.Kind() == reflect.Array && j >= v.Len() {
+			return p.errorf(join(name, child), "index out of range %s", v.Type())
+		}
+		if j >= maxIndex {
+			return p.errorf(join(name, child), "index over the limit of %d", maxIndex)
+		}
+		indices = append(indices, j)
+	}
+	if len(indices) == 0 {
+		return nil
+	}
+
+	if n := slices.Max(indices) + 1; v.Kind() == reflect.Slice && n > v.Len() {
+		grown := reflect.MakeSlice(v.Type(), n, n)
+		reflect.Copy(grown, v)
+		v.Set(grown)
+	}
+
+	for _, j := range indices {
+		if err := unmarshalValue(p, join(name, strconv.Itoa(j)), v.Index(j)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setScalar converts s to the type of v, allocating the pointers.
+func setScalar(v reflect.Value, s string) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	if u, ok := implements[encoding.TextUnmarshaler](v); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Complex64, reflect.Complex128:
+		c, err := strconv.ParseComplex(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetComplex(c)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedType, v.Type())
+	}
+	return nil
+}
+
+type (
+	Endpoint struct {
+		Host string `properties:"host"`
+		Port uint16 `properties:"port"`
+	}
+
+	Config struct {
+		Name      string               `properties:"name"`
+		Debug     *bool                `properties:"debug,omitempty"`
+		Ratio     float64              `properties:"ratio"`
+		Timeout   time.Duration        `properties:"timeout"`
+		Started   time.Time            `properties:"started"`
+		Tags      []string             `properties:"tags"`
+		Weights   [3]int8              `properties:"weights"`
+		Primary   *Endpoint            `properties:"primary"`
+		Replicas  []Endpoint           `properties:"replicas"`
+		Labels    map[string]string    `properties:"labels"`
+		Limits    map[string]*Endpoint `properties:"limits"`
+		Grid      [][]int              `properties:"grid"`
+		Password  string               `properties:"password,-"`
+		Untagged  int
+		unexposed int
+	}
+)
+
+func TestUnmarshal(t *testing.T) {
+	data := `name=api
+debug=true
+ratio=0.75
+timeout=1m30s
+started=2024-03-01T12:30:00Z
+tags=a,b,c
+weights=1,-2
+primary.host=localhost
+primary.port=8080
+replicas.1.host=replica
+replicas.1.port=8081
+labels.app.kubernetes.io/name=api
+limits.cpu.port=2
+grid.0=1,2
+grid.2=3
+password=secret
+untagged=7
+unknown=ignored
+`
+	var c Config
+	assert.NoError(t, Unmarshal([]byte(data), &c))
+	assert.Equal(t, Config{
+		Name:     "api",
+		Debug:    ptr(true),
+		Ratio:    0.75,
+		Timeout:  90 * time.Second,
+		Started:  time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		Tags:     []string{"a", "b", "c"},
+		Weights:  [3]int8{1, -2, 0},
+		Primary:  &Endpoint{Host: "localhost", Port: 8080},
+		Replicas: []Endpoint{{}, {Host: "replica", Port: 8081}},
+		Labels:   map[string]string{"app.kubernetes.io/name": "api"},
+		Limits:   map[string]*Endpoint{"cpu": {Port: 2}},
+		Grid:     [][]int{{1, 2}, nil, {3}},
+		Untagged: 7,
+	}, c)
+}
+
+func TestUnmarshal_KeepsMissingFields(t *testing.T) {
+	c := Config{Name: "default", Primary: &Endpoint{Host: "localhost", Port: 80}, Labels: map[string]string{"env": "dev"}}
+	assert.NoError(t, Unmarshal([]byte("primary.port=8080\r\nlabels.app = api\r\n\r\n"), &c))
+
+	assert.Equal(t, "default", c.Name)
+	assert.Equal(t, &Endpoint{Host: "localhost", Port: 8080}, c.Primary)
+	assert.Equal(t, map[string]string{"env": "dev", "app": "api"}, c.Labels)
+}
+
+func TestUnmarshal_Errors(t *testing.T) {
+	tests := map[string]struct {
+		data string
+		err  error
+		msg  string
+	}{
+		"invalid escape": {
+			data: "name=api\n\ntags=a,\\u00e",
+			err:  ErrInvalidEscape,
+			msg:  `line 3: tags: invalid unicode escape "\\u00e"`,
+		},
+		"invalid number": {
+			data: "name=api\nratio=high",
+			err:  strconv.ErrSyntax,
+			msg:  `line 2: ratio: strconv.ParseFloat: parsing "high": invalid syntax`,
+		},
+		"overflow": {
+			data: "primary.port=65536",
+			err:  strconv.ErrRange,
+			msg:  `line 1: primary.port: strconv.ParseUint: parsing "65536": value out of range`,
+		},
+		"invalid element": {
+			data: "weights=1,x",
+			err:  strconv.ErrSyntax,
+			msg:  `line 1: weights.1: strconv.ParseInt: parsing "x": invalid syntax`,
+		},
+		"array overflow": {
+			data: "weights=1,2,3,4",
+			msg:  "line 1: weights: 4 elements don't fit [3]int8",
+		},
+		"invalid index": {
+			data: "name=api\nreplicas.first.host=localhost",
+			msg:  "line 2: replicas.first: invalid index",
+		},
+		"huge index": {
+			data: "name=api\nreplicas.100000000000.host=x",
+			msg:  "line 2: replicas.100000000000: index over the limit of 65536",
+		},
+		"overflowing index": {
+			data: "replicas.9223372036854775807.host=x",
+			msg:  "line 1: replicas.9223372036854775807: index over the limit of 65536",
+		},
+		"index beyond int": {
+			data: "replicas.9223372036854775808.host=x",
+			msg:  "line 1: replicas.9223372036854775808: invalid index",
+		},
+		"nested rows of a scalar": {
+			data: "name.first=api",
+			err:  ErrUnsupportedType,
+			msg:  "line 1: name: unsupported type: string has nested rows",
+		},
+		"invalid time": {
+			data: "\nstarted=yesterday",
+			msg:  `line 2: started: parsing time "yesterday" as "2006-01-02T15:04:05Z07:00": cannot parse "yesterday" as "2006"`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var c Config
+			err := Unmarshal([]byte(test.data), &c)
+
+			var perr *ParseError
+			assert.True(t, errors.As(err, &perr))
+			if test.err != nil {
+				assert.ErrorIs(t, err, test.err)
+			}
+			assert.EqualError(t, err, test.msg)
+		})
+	}
+
+	var c Config
+	assert.ErrorIs(t, Unmarshal(nil, c), ErrNotAPointer)
+	assert.ErrorIs(t, Unmarshal(nil, (*Config)(nil)), ErrNilPtr)
+	assert.ErrorIs(t, Unmarshal(nil, ptr(42)), ErrNotAStruct)
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := map[string]any{
+		"empty person": &Person{},
+		"person":       &Person{Name: "John Doe", Address: "Paris", Age: 30, Married: true},
+		"config": &Config{
+			Name:     "api",
+			Debug:    ptr(false),
+			Ratio:    -1.5e-3,
+			Timeout:  1500 * time.Millisecond,
+			Started:  time.Date(2024, 3, 1, 12, 30, 0, 123, time.FixedZone("CET", 3600)),
+			Tags:     []string{"a", "b"},
+			Weights:  [3]int8{-128, 0, 127},
+			Primary:  &Endpoint{Host: "localhost", Port: 8080},
+			Replicas: []Endpoint{{Host: "first", Port: 1}, {Host: "second", Port: 2}},
+			Labels:   map[string]string{"app": "api", "env": "prod"},
+			Limits:   map[string]*Endpoint{"cpu": {Host: "a"}, "memory": {Host: "b"}},
+			Grid:     [][]int{{1, 2}, {3}},
+			Untagged: 7,
+		},
+		"pointers": &struct {
+			Str  *string   `properties:"str"`
+			Nums []*int    `properties:"nums"`
+			Nil  *Endpoint `properties:"nil"`
+		}{Str: ptr("string"), Nums: []*int{ptr(1), nil, ptr(3)}},
+	}
+
+	for name, in := range tests {
+		t.Run(name, func(t *testing.T) {
+			data, err := Marshal(in)
+			assert.NoError(t, err)
+
+			out := reflect.New(reflect.TypeOf(in).Elem())
+			assert.NoError(t, Unmarshal(data, out.Interface()))
+
+			if c, ok := in.(*Config); ok { // time.Time locations are compared by pointer.
+				assert.True(t, c.Started.Equal(out.Interface().(*Config).Started))
+				out.Interface().(*Config).Started = c.Started
+			}
+			assert.Equal(t, in, out.Interface())
+
+			again, err := Marshal(out.Interface())
+			assert.NoError(t, err)
+			assert.Equal(t, string(data), string(again))
+		})
+	}
+}
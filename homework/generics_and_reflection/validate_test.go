@@ -0,0 +1,719 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v -run 'Validat' .
+
+const (
+	validateTag = "validate"
+
+	ruleOmitEmpty = "omitempty"
+	ruleDive      = "dive"
+	ruleParamSep  = "="
+)
+
+var (
+	ErrInvalidRule = errors.New("invalid rule")
+	ErrRuleFailed  = errors.New("rule failed")
+)
+
+// ValidationError reports a value that breaks a rule.
+type ValidationError struct {
+	Path  string // e.g. Items[2].Name, empty for the validated value.
+	Rule  string
+	Param string
+	Err   error
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors are all the rules broken by a value, at most one per
+// field or element.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// ruleError is the message of a broken builtin rule, it matches
+// ErrRuleFailed.
+type ruleError string
+
+func (e ruleError) Error() string {
+	return string(e)
+}
+
+func (e ruleError) Is(target error) bool {
+	return target == ErrRuleFailed
+}
+
+func failed(format string, args ...any) error {
+	return ruleError(fmt.Sprintf(format, args...))
+}
+
+// RuleFunc checks the value of a field, param is the text after '=' in the
+// tag. Pointers are dereferenced before the call, nil ones are not checked.
+type RuleFunc func(v reflect.Value, param string) error
+
+type check func(v reflect.Value) error
+
+// compiler prepares a rule for the values of type t once, when the plan
+// of the struct is built, so the params are parsed once as well.
+type compiler func(param string, t reflect.Type) (check, error)
+
+// Validator checks the structs against their validate tags:
+//
+//	Name  string   `validate:"required,min=3,max=64"`
+//	Email string   `validate:"omitempty,email"`
+//	Tags  []string `validate:"max=10,dive,oneof=a b c"`
+//
+// The rules are separated by commas, a comma inside a param is escaped as
+// "\,". The rules after dive apply to the elements of a slice, an array or
+// a map instead of the value itself, omitempty skips the rest of the rules
+// for a zero value. The nested structs are always validated, the structs
+// in slices and maps only with dive. A struct reached twice through the
+// pointers, e.g. in a cyclic graph, is validated once. The first broken
+// rule of a field is reported.
+type Validator struct {
+	mu    sync.RWMutex
+	rules map[string]compiler
+	plans sync.Map // reflect.Type -> *validationPlan
+}
+
+func NewValidator() *Validator {
+	v := &Validator{rules: make(map[string]compiler, len(builtinRules))}
+	for name, rule := range builtinRules {
+		v.rules[name] = rule
+	}
+	return v
+}
+
+// Register adds a custom rule, replacing the one with the same name.
+func (val *Validator) Register(name string, fn RuleFunc) {
+	val.mu.Lock()
+	defer val.mu.Unlock()
+
+	val.rules[name] = func(param string, t reflect.Type) (check, error) {
+		return func(v reflect.Value) error { return fn(v, param) }, nil
+	}
+	val.plans.Clear() // the plans may have failed on the unknown rule.
+}
+
+var defaultValidator = NewValidator()
+
+// RegisterRule adds a custom rule to the validator used by Validate.
+func RegisterRule(name string, fn RuleFunc) {
+	defaultValidator.Register(name, fn)
+}
+
+// Validate checks v, a struct or a pointer to one, with the default
+// validator, see Validator.
+func Validate(v any) error {
+	return defaultValidator.Validate(v)
+}
+
+// Validate returns the ValidationErrors found in v, a struct or a pointer
+// to one, or the error of an invalid tag.
+func (val *Validator) Validate(v any) error {
+	rv, ok := deref(reflect.ValueOf(v))
+	if !ok {
+		return ErrNilPtr
+	}
+	if rv.Kind() != reflect.Struct {
+		return ErrNotAStruct
+	}
+
+	vs := validation{Validator: val, visited: make(map[visitKey]bool)}
+	if err := vs.validateStruct("", rv); err != nil {
+		return err
+	}
+	if len(vs.errs) > 0 {
+		return vs.errs
+	}
+	return nil
+}
+
+type ruleSet struct {
+	rules     []namedCheck
+	omitempty bool
+	dive      *ruleSet // for the elements.
+}
+
+type namedCheck struct {
+	name, param string
+	check       check
+}
+
+type validatedField struct {
+	index    int
+	name     string
+	embedded bool
+	rules    *ruleSet
+}
+
+type validationPlan struct {
+	fields []validatedField
+	err    error
+}
+
+func (val *Validator) planOf(t reflect.Type) ([]validatedField, error) {
+	p, ok := val.plans.Load(t)
+	if !ok {
+		p = val.storePlan(t)
+	}
+	plan := p.(*validationPlan)
+	return plan.fields, plan.err
+}
+
+// storePlan builds and stores the plan under the read lock, so Register
+// can't clear the plans in between and leave one built with the old rules.
+func (val *Validator) storePlan(t reflect.Type) any {
+	val.mu.RLock()
+	defer val.mu.RUnlock()
+
+	p, _ := val.plans.LoadOrStore(t, val.buildPlan(t))
+	return p
+}
+
+// buildPlan is called with val.mu held.
+func (val *Validator) buildPlan(t reflect.Type) *validationPlan {
+	var fields []validatedField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() && !f.Anonymous {
+			continue
+		}
+
+		rules, err := val.compile(splitList(f.Tag.Get(validateTag)), f.Type)
+		if err != nil {
+			return &validationPlan{err: fmt.Errorf("field %s.%s: %w", t, f.Name, err)}
+		}
+		fields = append(fields, validatedField{index: i, name: f.Name, embedded: f.Anonymous, rules: rules})
+	}
+	return &validationPlan{fields: fields}
+}
+
+// compile prepares the rules of the tag for the values of type t.
+func (val *Validator) compile(tokens []string, t reflect.Type) (*ruleSet, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	rs := &ruleSet{}
+	for i, token := range tokens {
+		token = strings.ReplaceAll(token, `\`+propsElemsSep, propsElemsSep)
+		name, param, _ := strings.Cut(token, ruleParamSep)
+		switch name {
+		case "":
+			continue
+		case ruleOmitEmpty:
+			rs.omitempty = true
+			continue
+		case ruleDive:
+			switch t.Kind() {
+			case reflect.Slice, reflect.Array, reflect.Map:
+			default:
+				return nil, fmt.Errorf("%w: can't dive into %s", ErrInvalidRule, t)
+			}
+			dive, err := val.compile(tokens[i+1:], t.Elem())
+			if err != nil {
+				return nil, err
+			}
+			rs.dive = dive
+			return rs, nil
+		}
+
+		compile, ok := val.rules[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown rule %q", ErrInvalidRule, name)
+		}
+		c, err := compile(param, t)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s: %w", ErrInvalidRule, token, err)
+		}
+		rs.rules = append(rs.rules, namedCheck{name: name, param: param, check: c})
+	}
+	return rs, nil
+}
+
+// validation is the state of a single Validate call.
+type validation struct {
+	*Validator
+	errs    ValidationErrors
+	visited map[visitKey]bool
+}
+
+func (vs *validation) validateStruct(path string, v reflect.Value) error {
+	if v.CanAddr() {
+		key := visitKey{ptr: v.UnsafeAddr(), typ: v.Type()}
+		if vs.visited[key] {
+			return nil
+		}
+		vs.visited[key] = true
+	}
+
+	fields, err := vs.planOf(v.Type())
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		name := path
+		if !f.embedded {
+			name = joinPath(path, f.name)
+		}
+		if err := vs.validate(name, v.Field(f.index), f.rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vs *validation) validate(path string, v reflect.Value, rs *ruleSet) error {
+	if rs.omitempty && (!v.IsValid() || v.IsZero()) {
+		return nil
+	}
+
+	v, ok := deref(v)
+	for _, r := range rs.rules {
+		if !ok && r.name != "required" {
+			continue
+		}
+		if !ok {
+			v = reflect.Value{}
+		}
+		if err := r.check(v); err != nil {
+			vs.errs = append(vs.errs, &ValidationError{Path: path, Rule: r.name, Param: r.param, Err: err})
+			return nil
+		}
+	}
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case rs.dive != nil && v.Kind() == reflect.Map:
+		for iter := v.MapRange(); iter.Next(); {
+			elem := fmt.Sprintf("%s[%v]", path, iter.Key())
+			if err := vs.validate(elem, iter.Value(), rs.dive); err != nil {
+				return err
+			}
+		}
+	case rs.dive != nil:
+		for i := 0; i < v.Len(); i++ {
+			elem := fmt.Sprintf("%s[%d]", path, i)
+			if err := vs.validate(elem, v.Index(i), rs.dive); err != nil {
+				return err
+			}
+		}
+	case v.Kind() == reflect.Struct:
+		return vs.validateStruct(path, v)
+	}
+	return nil
+}
+
+var builtinRules = map[string]compiler{
+	"required": compileRequired,
+	"min":      compileCompare("min"),
+	"max":      compileCompare("max"),
+	"len":      compileCompare("len"),
+	"oneof":    compileOneOf,
+	"regex":    compileRegex,
+	"email":    compileEmail,
+}
+
+func compileRequired(param string, t reflect.Type) (check, error) {
+	return func(v reflect.Value) error {
+		if !v.IsValid() || v.IsZero() {
+			return ErrRequired
+		}
+		switch v.Kind() {
+		case reflect.String, reflect.Slice, reflect.Map:
+			if v.Len() == 0 {
+				return ErrRequired
+			}
+		}
+		return nil
+	}, nil
+}
+
+// compileCompare compiles min, max and len: the value of the numbers, the
+// length of the strings in runes and the length of the collections.
+func compileCompare(op string) compiler {
+	return func(param string, t reflect.Type) (check, error) {
+		var measure func(v reflect.Value) float64
+		var limit float64
+		var what string
+
+		switch t.Kind() {
+		case reflect.String:
+			measure = func(v reflect.Value) float64 { return float64(utf8.RuneCountInString(v.String())) }
+			what = "length"
+		case reflect.Slice, reflect.Array, reflect.Map:
+			measure = func(v reflect.Value) float64 { return float64(v.Len()) }
+			what = "length"
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			measure = func(v reflect.Value) float64 { return float64(v.Int()) }
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			measure = func(v reflect.Value) float64 { return float64(v.Uint()) }
+		case reflect.Float32, reflect.Float64:
+			measure = func(v reflect.Value) float64 { return v.Float() }
+		default:
+			return nil, fmt.Errorf("unsupported by %s", t)
+		}
+
+		var err error
+		if t == durationType {
+			var d time.Duration
+			d, err = time.ParseDuration(param)
+			limit = float64(d)
+		} else {
+			limit, err = strconv.ParseFloat(param, 64)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		subject := "must be"
+		if what != "" {
+			subject = what + " must be"
+		}
+		return func(v reflect.Value) error {
+			switch m := measure(v); {
+			case op == "min" && m < limit:
+				return failed("%s at least %s", subject, param)
+			case op == "max" && m > limit:
+				return failed("%s at most %s", subject, param)
+			case op == "len" && m != limit:
+				return failed("%s %s", subject, param)
+			}
+			return nil
+		}, nil
+	}
+}
+
+func compileOneOf(param string, t reflect.Type) (check, error) {
+	if !simple(t.Kind()) {
+		return nil, fmt.Errorf("unsupported by %s", t)
+	}
+	allowed := strings.Fields(param)
+	return func(v reflect.Value) error {
+		s := v2s(v)
+		for _, a := range allowed {
+			if s == a {
+				return nil
+			}
+		}
+		return failed("must be one of %v", allowed)
+	}, nil
+}
+
+func compileRegex(param string, t reflect.Type) (check, error) {
+	if t.Kind() != reflect.String {
+		return nil, fmt.Errorf("unsupported by %s", t)
+	}
+	re, err := regexp.Compile(param)
+	if err != nil {
+		return nil, err
+	}
+	return func(v reflect.Value) error {
+		if !re.MatchString(v.String()) {
+			return failed("must match %s", param)
+		}
+		return nil
+	}, nil
+}
+
+func compileEmail(param string, t reflect.Type) (check, error) {
+	if t.Kind() != reflect.String {
+		return nil, fmt.Errorf("unsupported by %s", t)
+	}
+	return func(v reflect.Value) error {
+		addr, err := mail.ParseAddress(v.String())
+		if err != nil || addr.Address != v.String() {
+			return failed("must be an email address")
+		}
+		return nil
+	}, nil
+}
+
+type (
+	OrderItem struct {
+		Name     string  `validate:"required,min=2"`
+		Quantity int     `validate:"min=1,max=100"`
+		Price    float64 `validate:"min=0.01"`
+	}
+
+	Customer struct {
+		Email string `validate:"required,email"`
+		Phone string `validate:"omitempty,regex=^\\+[0-9]{7\\,15}$"`
+	}
+
+	Order struct {
+		ID       string            `validate:"len=8"`
+		Status   string            `validate:"oneof=new paid shipped"`
+		Customer *Customer         `validate:"required"`
+		Items    []OrderItem       `validate:"min=1,dive"`
+		Tags     []string          `validate:"max=3,dive,min=1,max=10"`
+		Metadata map[string]string `validate:"dive,max=16"`
+		Timeout  time.Duration     `validate:"max=1m"`
+		Coupon   *string           `validate:"omitempty,len=6"`
+		Notes    string
+	}
+)
+
+func validOrder() Order {
+	return Order{
+		ID:       "A0000001",
+		Status:   "new",
+		Customer: &Customer{Email: "john@example.com", Phone: "+3312345678"},
+		Items:    []OrderItem{{Name: "book", Quantity: 1, Price: 9.99}},
+		Tags:     []string{"gift"},
+		Metadata: map[string]string{"source": "web"},
+		Timeout:  time.Second,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	order := validOrder()
+	assert.NoError(t, Validate(order))
+	assert.NoError(t, Validate(&order))
+
+	order = Order{
+		ID:     "A1",
+		Status: "lost",
+		Items: []OrderItem{
+			{Name: "book", Quantity: 1, Price: 9.99},
+			{Name: "pen", Quantity: 0, Price: 1},
+			{Name: "x", Quantity: 1, Price: 0},
+		},
+		Tags:     []string{"a", ""},
+		Metadata: map[string]string{"source": strings.Repeat("x", 17)},
+		Timeout:  time.Hour,
+		Coupon:   ptr("SAVE"),
+	}
+
+	err := Validate(order)
+	assert.ErrorIs(t, err, ErrRuleFailed)
+	assert.ErrorIs(t, err, ErrRequired)
+	assert.Equal(t, "ID: length must be 8\n"+
+		"Status: must be one of [new paid shipped]\n"+
+		"Customer: required\n"+
+		"Items[1].Quantity: must be at least 1\n"+
+		"Items[2].Name: length must be at least 2\n"+
+		"Items[2].Price: must be at least 0.01\n"+
+		"Tags[1]: length must be at least 1\n"+
+		"Metadata[source]: length must be at most 16\n"+
+		"Timeout: must be at most 1m\n"+
+		"Coupon: length must be 6", err.Error())
+
+	var verrs ValidationErrors
+	assert.True(t, errors.As(err, &verrs))
+	assert.Len(t, verrs, 10)
+	assert.Equal(t, &ValidationError{Path: "Items[2].Name", Rule: "min", Param: "2", Err: verrs[4].Err}, verrs[4])
+
+	order = validOrder()
+	order.Customer = &Customer{Email: "John <john@example.com>", Phone: "123"}
+	order.Items = nil
+	err = Validate(order)
+	assert.EqualError(t, err, "Customer.Email: must be an email address\n"+
+		`Customer.Phone: must match ^\+[0-9]{7,15}$`+"\n"+
+		"Items: length must be at least 1")
+}
+
+func TestValidate_Embedded(t *testing.T) {
+	type Timestamps struct {
+		Created time.Time `validate:"required"`
+	}
+	type Named struct {
+		Timestamps
+		Name string `validate:"required"`
+	}
+
+	err := Validate(&Named{})
+	assert.EqualError(t, err, "Created: required\nName: required")
+	assert.NoError(t, Validate(Named{Timestamps: Timestamps{Created: time.Now()}, Name: "name"}))
+
+	assert.ErrorIs(t, Validate((*Named)(nil)), ErrNilPtr)
+	assert.ErrorIs(t, Validate("name"), ErrNotAStruct)
+}
+
+func TestValidate_InvalidTag(t *testing.T) {
+	tests := map[string]struct {
+		in  any
+		msg string
+	}{
+		"unknown rule": {
+			in: struct {
+				Name string `validate:"required,uuid"`
+			}{},
+			msg: `field struct { Name string "validate:\"required,uuid\"" }.Name: invalid rule: unknown rule "uuid"`,
+		},
+		"invalid param": {
+			in: OrderItemWithInvalidTag{},
+			msg: `field main.OrderItemWithInvalidTag.Quantity: invalid rule min=one: ` +
+				`strconv.ParseFloat: parsing "one": invalid syntax`,
+		},
+		"unsupported type": {
+			in: struct {
+				Enabled bool `validate:"min=1"`
+			}{},
+			msg: `field struct { Enabled bool "validate:\"min=1\"" }.Enabled: invalid rule min=1: unsupported by bool`,
+		},
+		"dive into a scalar": {
+			in: struct {
+				Name string `validate:"dive,required"`
+			}{},
+			msg: `field struct { Name string "validate:\"dive,required\"" }.Name: invalid rule: can't dive into string`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := Validate(test.in)
+			assert.ErrorIs(t, err, ErrInvalidRule)
+			assert.EqualError(t, err, test.msg)
+		})
+	}
+}
+
+type OrderItemWithInvalidTag struct {
+	Quantity int `validate:"min=one"`
+}
+
+func TestValidate_Dive(t *testing.T) {
+	type Matrix struct {
+		Rows   [][]int               `validate:"len=2,dive,len=2,dive,min=0"`
+		Owners map[string]*OrderItem `validate:"dive,required"`
+	}
+
+	m := Matrix{
+		Rows:   [][]int{{1, 2}, {3, -4}},
+		Owners: map[string]*OrderItem{"nil": nil, "bad": {Name: "b", Quantity: 1, Price: 1}},
+	}
+
+	verrs := Validate(m).(ValidationErrors)
+	paths := make([]string, len(verrs))
+	for i, err := range verrs {
+		paths[i] = err.Path
+	}
+	assert.ElementsMatch(t, []string{"Rows[1][1]", "Owners[nil]", "Owners[bad].Name"}, paths)
+}
+
+type Employee struct {
+	Name    string      `validate:"required"`
+	Manager *Employee   `validate:"omitempty"`
+	Reports []*Employee `validate:"dive,required"`
+}
+
+func TestValidate_Cycles(t *testing.T) {
+	boss := &Employee{Name: "boss"}
+	dev := &Employee{Manager: boss}
+	boss.Manager = boss // a self loop.
+	boss.Reports = []*Employee{dev, dev}
+
+	// dev is reached twice, its error is reported once.
+	assert.EqualError(t, Validate(boss), "Reports[0].Name: required")
+
+	dev.Name = "dev"
+	assert.NoError(t, Validate(dev))
+}
+
+func TestValidator_Register(t *testing.T) {
+	type Account struct {
+		Login string `validate:"required,notblank,prefix=u_"`
+		Pin   int    `validate:"even"`
+	}
+
+	val := NewValidator()
+	assert.ErrorIs(t, val.Validate(Account{}), ErrInvalidRule)
+
+	errOdd := errors.New("must be even")
+	val.Register("notblank", func(v reflect.Value, param string) error {
+		if strings.TrimSpace(v.String()) == "" {
+			return errors.New("must not be blank")
+		}
+		return nil
+	})
+	val.Register("prefix", func(v reflect.Value, param string) error {
+		if !strings.HasPrefix(v.String(), param) {
+			return fmt.Errorf("must start with %q", param)
+		}
+		return nil
+	})
+	val.Register("even", func(v reflect.Value, param string) error {
+		if v.Int()%2 != 0 {
+			return errOdd
+		}
+		return nil
+	})
+
+	err := val.Validate(Account{Login: "  ", Pin: 3})
+	assert.ErrorIs(t, err, errOdd)
+	assert.EqualError(t, err, "Login: must not be blank\nPin: must be even")
+
+	assert.EqualError(t, val.Validate(Account{Login: "john", Pin: 2}), `Login: must start with "u_"`)
+	assert.NoError(t, val.Validate(Account{Login: "u_john", Pin: 2}))
+
+	// the default validator doesn't know the rules.
+	assert.ErrorIs(t, Validate(Account{}), ErrInvalidRule)
+}
+
+func TestValidator_PlanCache(t *testing.T) {
+	val := NewValidator()
+	typ := reflect.TypeFor[Order]()
+
+	fields, err := val.planOf(typ)
+	assert.NoError(t, err)
+	again, _ := val.planOf(typ)
+	assert.Same(t, fields[0].rules, again[0].rules)
+
+	val.Register("custom", func(reflect.Value, string) error { return nil })
+	again, _ = val.planOf(typ)
+	assert.NotSame(t, fields[0].rules, again[0].rules)
+}
+
+func BenchmarkValidate(b *testing.B) {
+	order := validOrder()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := Validate(&order); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
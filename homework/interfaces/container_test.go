@@ -0,0 +1,670 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v .
+
+var (
+	ErrNotRegistered      = errors.New("service is not registered")
+	ErrAlreadyRegistered  = errors.New("service is already registered")
+	ErrInvalidConstructor = errors.New("invalid constructor")
+	ErrDependencyCycle    = errors.New("dependency cycle")
+	ErrScopeRequired      = errors.New("scoped service resolved outside of a scope")
+)
+
+// DependencyError reports the chain of dependencies that led to Err,
+// e.g. the services involved in a cycle or the one that needs a missing
+// service.
+type DependencyError struct {
+	Path []serviceKey
+	Err  error
+}
+
+func (e *DependencyError) Error() string {
+	path := make([]string, len(e.Path))
+	for i, k := range e.Path {
+		path[i] = k.String()
+	}
+	return fmt.Sprintf("resolve %s: %v", strings.Join(path, " -> "), e.Err)
+}
+
+func (e *DependencyError) Unwrap() error {
+	return e.Err
+}
+
+// serviceKey identifies a service by its type and an optional name, so
+// that several implementations of the same type can be registered.
+type serviceKey struct {
+	typ  reflect.Type
+	name string
+}
+
+func keyOf[T any](name string) serviceKey {
+	return serviceKey{typ: reflect.TypeFor[T](), name: name}
+}
+
+func (k serviceKey) String() string {
+	if k.name == "" {
+		return k.typ.String()
+	}
+	return fmt.Sprintf("%s(%q)", k.typ, k.name)
+}
+
+// Lifetime defines how often a service is built.
+type Lifetime int
+
+const (
+	Transient Lifetime = iota // every Resolve builds a new instance.
+	Singleton                 // built once on the first Resolve, shared by all scopes.
+	Scoped                    // built once per scope, see NewScope.
+)
+
+type provider struct {
+	key      serviceKey
+	lifetime Lifetime
+	deps     []serviceKey // resolved and passed to build in this order.
+	build    func(deps []any) (any, error)
+}
+
+// instance is a built singleton or scoped service. The mutex makes
+// concurrent resolutions wait for a single call of the constructor, it is
+// not held while the dependencies are resolved.
+type instance struct {
+	mu    sync.Mutex
+	built bool
+	value any
+}
+
+type registration struct {
+	name     string
+	lifetime Lifetime
+}
+
+type RegisterOption func(r *registration)
+
+// Named registers the service under a name in addition to its type.
+func Named(name string) RegisterOption {
+	return func(r *registration) {
+		r.name = name
+	}
+}
+
+// WithLifetime sets the lifetime of the service, Transient by default.
+func WithLifetime(lifetime Lifetime) RegisterOption {
+	return func(r *registration) {
+		r.lifetime = lifetime
+	}
+}
+
+// register adds the provider to the root container, so that services
+// registered through a scope are visible everywhere.
+func (c *Container) register(p *provider) error {
+	c = c.root()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.services[p.key]; ok {
+		return fmt.Errorf("%w: %s", ErrAlreadyRegistered, p.key)
+	}
+	c.services[p.key] = p
+	return nil
+}
+
+func (c *Container) provider(key serviceKey) (*provider, error) {
+	c = c.root()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	p, ok := c.services[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotRegistered, key)
+	}
+	return p, nil
+}
+
+// Register registers ctor as the constructor of T, every Resolve calls it
+// again. T may be an interface type.
+func Register[T any](c *Container, ctor func() (T, error), opts ...RegisterOption) error {
+	var r registration
+	for _, opt := range opts {
+		opt(&r)
+	}
+
+	key := keyOf[T](r.name)
+	if ctor == nil {
+		return fmt.Errorf("%w: nil constructor for %s", ErrInvalidConstructor, key)
+	}
+	return c.register(&provider{
+		key:      key,
+		lifetime: r.lifetime,
+		build: func([]any) (any, error) {
+			return ctor()
+		},
+	})
+}
+
+var errorType = reflect.TypeFor[error]()
+
+// Provide registers a constructor whose parameters are services resolved
+// from the container, e.g. func(*UserService, Logger) (*MessageService, error).
+// The constructor returns the service and optionally an error, the service
+// is registered under the type of its first result.
+func Provide(c *Container, ctor any, opts ...RegisterOption) error {
+	var r registration
+	for _, opt := range opts {
+		opt(&r)
+	}
+
+	fn := reflect.ValueOf(ctor)
+	if fn.Kind() != reflect.Func || fn.IsNil() {
+		return fmt.Errorf("%w: %T is not a function", ErrInvalidConstructor, ctor)
+	}
+
+	typ := fn.Type()
+	if typ.IsVariadic() {
+		return fmt.Errorf("%w: %s is variadic", ErrInvalidConstructor, typ)
+	}
+	switch {
+	case typ.NumOut() == 1 && typ.Out(0) != errorType:
+	case typ.NumOut() == 2 && typ.Out(0) != errorType && typ.Out(1) == errorType:
+	default:
+		return fmt.Errorf("%w: %s must return T or (T, error)", ErrInvalidConstructor, typ)
+	}
+
+	deps := make([]serviceKey, typ.NumIn())
+	for i := range deps {
+		deps[i] = serviceKey{typ: typ.In(i)}
+	}
+
+	return c.register(&provider{
+		key:      serviceKey{typ: typ.Out(0), name: r.name},
+		lifetime: r.lifetime,
+		deps:     deps,
+		build: func(deps []any) (any, error) {
+			args := make([]reflect.Value, len(deps))
+			for i, dep := range deps {
+				if dep == nil { // a nil interface has no reflect.Value.
+					args[i] = reflect.Zero(typ.In(i))
+				} else {
+					args[i] = reflect.ValueOf(dep)
+				}
+			}
+
+			out := fn.Call(args)
+			if len(out) == 2 && !out[1].IsNil() {
+				return nil, out[1].Interface().(error)
+			}
+			return out[0].Interface(), nil
+		},
+	})
+}
+
+// RegisterInstance registers a ready value of T, every Resolve returns it.
+func RegisterInstance[T any](c *Container, value T, opts ...RegisterOption) error {
+	return Register(c, func() (T, error) { return value, nil }, opts...)
+}
+
+// Resolve builds the unnamed service of type T.
+func Resolve[T any](c *Container) (T, error) {
+	return ResolveNamed[T](c, "")
+}
+
+// ResolveNamed builds the service of type T registered with Named(name).
+func ResolveNamed[T any](c *Container, name string) (T, error) {
+	var zero T
+
+	v, err := c.resolve(keyOf[T](name), nil)
+	if err != nil {
+		return zero, err
+	}
+	service, _ := v.(T) // a nil interface stays the zero value.
+	return service, nil
+}
+
+// resolve builds the service and its dependencies, path is the chain of
+// services being built that depend on it.
+func (c *Container) resolve(key serviceKey, path []serviceKey) (any, error) {
+	path = append(path, key)
+	for _, k := range path[:len(path)-1] {
+		if k == key {
+			return nil, &DependencyError{Path: path, Err: ErrDependencyCycle}
+		}
+	}
+
+	p, err := c.provider(key)
+	if err != nil {
+		if len(path) == 1 {
+			return nil, err
+		}
+		return nil, &DependencyError{Path: path, Err: ErrNotRegistered}
+	}
+
+	owner := c // the container that keeps the instance.
+	switch p.lifetime {
+	case Transient:
+		return c.build(p, path)
+	case Singleton:
+		owner = c.root()
+	case Scoped:
+		if c.parent == nil {
+			return nil, &DependencyError{Path: path, Err: ErrScopeRequired}
+		}
+	}
+
+	owner.mu.Lock()
+	inst, ok := owner.instances[key]
+	if !ok {
+		inst = &instance{}
+		owner.instances[key] = inst
+	}
+	owner.mu.Unlock()
+
+	inst.mu.Lock()
+	v, built := inst.value, inst.built
+	inst.mu.Unlock()
+	if built {
+		return v, nil
+	}
+
+	// singletons are built from the root, so they can't capture a scoped
+	// service that would outlive its scope. The dependencies are resolved
+	// without the lock: two goroutines resolving the services of a cycle
+	// would wait for each other instead of finding it.
+	deps, err := owner.resolveDeps(p, path)
+	if err != nil {
+		return nil, err
+	}
+
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	if inst.built { // by another goroutine in the meantime.
+		return inst.value, nil
+	}
+	v, err = construct(p, deps, path)
+	if err != nil {
+		return nil, err // not remembered: the next Resolve tries again.
+	}
+	inst.value, inst.built = v, true
+
+	owner.mu.Lock()
+	owner.created = append(owner.created, v)
+	owner.mu.Unlock()
+	return v, nil
+}
+
+func (c *Container) build(p *provider, path []serviceKey) (any, error) {
+	deps, err := c.resolveDeps(p, path)
+	if err != nil {
+		return nil, err
+	}
+	return construct(p, deps, path)
+}
+
+func (c *Container) resolveDeps(p *provider, path []serviceKey) ([]any, error) {
+	deps := make([]any, len(p.deps))
+	for i, dep := range p.deps {
+		var err error
+		if deps[i], err = c.resolve(dep, path); err != nil {
+			return nil, err
+		}
+	}
+	return deps, nil
+}
+
+// construct calls the constructor with the resolved dependencies.
+func construct(p *provider, deps []any, path []serviceKey) (any, error) {
+	v, err := p.build(deps)
+	if err != nil {
+		var derr *DependencyError
+		if errors.As(err, &derr) {
+			return nil, err
+		}
+		return nil, &DependencyError{Path: path, Err: err}
+	}
+	return v, nil
+}
+
+// Validate checks the whole dependency graph without building anything:
+// every dependency must be registered, there must be no cycles and
+// singletons must not depend on scoped services. All the problems found
+// are returned joined.
+func (c *Container) Validate() error {
+	c = c.root()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	keys := make([]serviceKey, 0, len(c.services))
+	for k := range c.services {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[serviceKey]int, len(keys))
+
+	var errs []error
+	var visit func(path []serviceKey)
+	visit = func(path []serviceKey) {
+		key := path[len(path)-1]
+		state[key] = visiting
+		for _, dep := range c.services[key].deps {
+			depPath := append(slices.Clip(path), dep)
+			p, ok := c.services[dep]
+			if !ok {
+				errs = append(errs, &DependencyError{Path: depPath, Err: ErrNotRegistered})
+				continue
+			}
+			if p.lifetime == Scoped && c.services[key].lifetime == Singleton {
+				errs = append(errs, &DependencyError{Path: depPath, Err: ErrScopeRequired})
+			}
+
+			switch state[dep] {
+			case visiting:
+				start := slices.Index(path, dep)
+				errs = append(errs, &DependencyError{Path: depPath[start:], Err: ErrDependencyCycle})
+			case unvisited:
+				visit(depPath)
+			}
+		}
+		state[key] = visited
+	}
+
+	for _, k := range keys {
+		if state[k] == unvisited {
+			visit([]serviceKey{k})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type Logger interface {
+	Log(msg string)
+}
+
+type memoryLogger struct {
+	prefix string
+	lines  []string
+}
+
+func (l *memoryLogger) Log(msg string) {
+	l.lines = append(l.lines, l.prefix+msg)
+}
+
+func TestRegisterResolve(t *testing.T) {
+	container := NewContainer()
+	assert.NoError(t, Register(container, func() (*UserService, error) {
+		return &UserService{}, nil
+	}))
+
+	u1, err := Resolve[*UserService](container)
+	assert.NoError(t, err)
+	u2, err := Resolve[*UserService](container)
+	assert.NoError(t, err)
+	assert.NotNil(t, u1)
+	assert.False(t, u1 == u2)
+
+	_, err = Resolve[*MessageService](container)
+	assert.ErrorIs(t, err, ErrNotRegistered)
+	assert.EqualError(t, err, "service is not registered: *main.MessageService")
+
+	// the value type is a different service than the pointer type.
+	_, err = Resolve[UserService](container)
+	assert.ErrorIs(t, err, ErrNotRegistered)
+}
+
+func TestRegisterResolve_Interface(t *testing.T) {
+	container := NewContainer()
+	logger := &memoryLogger{}
+	assert.NoError(t, RegisterInstance[Logger](container, logger))
+
+	resolved, err := Resolve[Logger](container)
+	assert.NoError(t, err)
+	resolved.Log("hello")
+	assert.Equal(t, []string{"hello"}, logger.lines)
+
+	_, err = Resolve[*memoryLogger](container)
+	assert.ErrorIs(t, err, ErrNotRegistered)
+}
+
+func TestRegisterResolve_Named(t *testing.T) {
+	container := NewContainer()
+	assert.NoError(t, RegisterInstance[Logger](container, &memoryLogger{prefix: "default: "}))
+	assert.NoError(t, RegisterInstance[Logger](container, &memoryLogger{prefix: "audit: "}, Named("audit")))
+
+	audit, err := ResolveNamed[Logger](container, "audit")
+	assert.NoError(t, err)
+	audit.Log("login")
+	assert.Equal(t, []string{"audit: login"}, audit.(*memoryLogger).lines)
+
+	def, err := Resolve[Logger](container)
+	assert.NoError(t, err)
+	assert.Equal(t, "default: ", def.(*memoryLogger).prefix)
+
+	_, err = ResolveNamed[Logger](container, "metrics")
+	assert.EqualError(t, err, `service is not registered: main.Logger("metrics")`)
+}
+
+func TestRegisterResolve_Errors(t *testing.T) {
+	container := NewContainer()
+
+	err := Register[*UserService](container, nil)
+	assert.ErrorIs(t, err, ErrInvalidConstructor)
+
+	assert.NoError(t, RegisterInstance(container, &UserService{}))
+	err = RegisterInstance(container, &UserService{})
+	assert.ErrorIs(t, err, ErrAlreadyRegistered)
+	assert.NoError(t, RegisterInstance(container, &UserService{}, Named("other")))
+
+	errNoDatabase := errors.New("no database")
+	assert.NoError(t, Register(container, func() (*MessageService, error) {
+		return nil, errNoDatabase
+	}))
+	_, err = Resolve[*MessageService](container)
+	assert.ErrorIs(t, err, errNoDatabase)
+	assert.EqualError(t, err, "resolve *main.MessageService: no database")
+
+	var derr *DependencyError
+	assert.True(t, errors.As(err, &derr))
+
+	// a nil interface is a valid value.
+	assert.NoError(t, RegisterInstance[Logger](container, nil))
+	logger, err := Resolve[Logger](container)
+	assert.NoError(t, err)
+	assert.Nil(t, logger)
+}
+
+func TestRegisterResolve_WithStringAPI(t *testing.T) {
+	container := NewContainer()
+	container.RegisterType("UserService", func() interface{} {
+		return &UserService{}
+	})
+	assert.NoError(t, RegisterInstance(container, &UserService{NotEmptyStruct: true}))
+
+	byName, err := container.Resolve("UserService")
+	assert.NoError(t, err)
+	assert.False(t, byName.(*UserService).NotEmptyStruct)
+
+	byType, err := Resolve[*UserService](container)
+	assert.NoError(t, err)
+	assert.True(t, byType.NotEmptyStruct)
+}
+
+type Database struct {
+	DSN string
+}
+
+type UserRepository struct {
+	db *Database
+}
+
+type NotificationService struct {
+	users    *UserService
+	messages *MessageService
+	logger   Logger
+}
+
+func TestProvide(t *testing.T) {
+	container := NewContainer()
+	logger := &memoryLogger{}
+
+	assert.NoError(t, RegisterInstance[Logger](container, logger))
+	assert.NoError(t, Provide(container, func() *UserService {
+		return &UserService{}
+	}))
+	assert.NoError(t, Provide(container, func(users *UserService, logger Logger) (*MessageService, error) {
+		logger.Log("message service created")
+		return &MessageService{NotEmptyStruct: users != nil}, nil
+	}))
+	assert.NoError(t, Provide(container, func(users *UserService, messages *MessageService, logger Logger) *NotificationService {
+		return &NotificationService{users: users, messages: messages, logger: logger}
+	}))
+	assert.NoError(t, container.Validate())
+
+	ns, err := Resolve[*NotificationService](container)
+	assert.NoError(t, err)
+	assert.NotNil(t, ns.users)
+	assert.True(t, ns.messages.NotEmptyStruct)
+	assert.Equal(t, logger, ns.logger)
+	assert.Equal(t, []string{"message service created"}, logger.lines)
+}
+
+func TestProvide_InvalidConstructor(t *testing.T) {
+	container := NewContainer()
+
+	tests := map[string]any{
+		"not a function":     &UserService{},
+		"nil function":       (func() *UserService)(nil),
+		"no results":         func() {},
+		"only error":         func() error { return nil },
+		"second not error":   func() (*UserService, int) { return nil, 0 },
+		"too many results":   func() (*UserService, *MessageService, error) { return nil, nil, nil },
+		"variadic arguments": func(...Logger) *UserService { return nil },
+	}
+
+	for name, ctor := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.ErrorIs(t, Provide(container, ctor), ErrInvalidConstructor)
+		})
+	}
+}
+
+func TestProvide_ConstructorError(t *testing.T) {
+	container := NewContainer()
+	errUnreachable := errors.New("database is unreachable")
+
+	assert.NoError(t, Provide(container, func() (*Database, error) {
+		return nil, errUnreachable
+	}))
+	assert.NoError(t, Provide(container, func(db *Database) *UserRepository {
+		return &UserRepository{db: db}
+	}))
+
+	_, err := Resolve[*UserRepository](container)
+	assert.ErrorIs(t, err, errUnreachable)
+	assert.EqualError(t, err, "resolve *main.UserRepository -> *main.Database: database is unreachable")
+}
+
+func TestProvide_MissingDependency(t *testing.T) {
+	container := NewContainer()
+	assert.NoError(t, Provide(container, func(db *Database) *UserRepository {
+		return &UserRepository{db: db}
+	}))
+	assert.NoError(t, Provide(container, func(repo *UserRepository, logger Logger) *UserService {
+		return &UserService{}
+	}))
+
+	_, err := Resolve[*UserService](container)
+	assert.ErrorIs(t, err, ErrNotRegistered)
+	assert.EqualError(t, err, "resolve *main.UserService -> *main.UserRepository -> *main.Database: service is not registered")
+
+	err = container.Validate()
+	assert.ErrorIs(t, err, ErrNotRegistered)
+	assert.EqualError(t, err, ""+
+		"resolve *main.UserRepository -> *main.Database: service is not registered\n"+
+		"resolve *main.UserService -> main.Logger: service is not registered")
+}
+
+type serviceA struct{}
+type serviceB struct{}
+type serviceC struct{}
+
+func TestProvide_Cycle(t *testing.T) {
+	container := NewContainer()
+	assert.NoError(t, Provide(container, func(*serviceB) *serviceA { return &serviceA{} }))
+	assert.NoError(t, Provide(container, func(*serviceC) *serviceB { return &serviceB{} }))
+	assert.NoError(t, Provide(container, func(*serviceA) *serviceC { return &serviceC{} }))
+	assert.NoError(t, Provide(container, func(*serviceB) *UserService { return &UserService{} }))
+
+	_, err := Resolve[*UserService](container)
+	assert.ErrorIs(t, err, ErrDependencyCycle)
+	assert.EqualError(t, err, "resolve *main.UserService -> *main.serviceB -> *main.serviceC -> *main.serviceA -> *main.serviceB: dependency cycle")
+
+	err = container.Validate()
+	assert.ErrorIs(t, err, ErrDependencyCycle)
+	assert.EqualError(t, err, "resolve *main.serviceB -> *main.serviceC -> *main.serviceA -> *main.serviceB: dependency cycle")
+
+	self := NewContainer()
+	assert.NoError(t, Provide(self, func(*serviceA) *serviceA { return &serviceA{} }))
+	assert.EqualError(t, self.Validate(), "resolve *main.serviceA -> *main.serviceA: dependency cycle")
+}
+
+func TestProvide_ConcurrentCycle(t *testing.T) {
+	// both goroutines are inside the first dependency of their service
+	// before going on to the other service of the cycle.
+	var ready sync.WaitGroup
+	ready.Add(2)
+	rendezvous := func(once *sync.Once) {
+		once.Do(func() {
+			ready.Done()
+			ready.Wait()
+		})
+	}
+
+	var dbOnce, loggerOnce sync.Once
+	container := NewContainer()
+	assert.NoError(t, Register(container, func() (*Database, error) {
+		rendezvous(&dbOnce)
+		return &Database{}, nil
+	}))
+	assert.NoError(t, Register(container, func() (Logger, error) {
+		rendezvous(&loggerOnce)
+		return &memoryLogger{}, nil
+	}))
+	assert.NoError(t, Provide(container, func(*Database, *serviceB) *serviceA { return &serviceA{} }, WithLifetime(Singleton)))
+	assert.NoError(t, Provide(container, func(Logger, *serviceA) *serviceB { return &serviceB{} }, WithLifetime(Singleton)))
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := Resolve[*serviceA](container)
+		errs <- err
+	}()
+	go func() {
+		_, err := Resolve[*serviceB](container)
+		errs <- err
+	}()
+
+	for range 2 {
+		select {
+		case err := <-errs:
+			assert.ErrorIs(t, err, ErrDependencyCycle)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the resolutions of the cycle are deadlocked")
+		}
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 )
 
-// go test -v homework_test.go
+// go test -v .
 
 type UserService struct {
 	// not need to implement
@@ -20,32 +23,70 @@ type MessageService struct {
 }
 
 type Container struct {
-	types map[string]interface{}
+	parent *Container // nil for the root container, see NewScope.
+
+	mu        sync.RWMutex
+	types     map[string]interface{}
+	services  map[serviceKey]*provider // see Register and Resolve.
+	instances map[serviceKey]*instance // singletons in the root, scoped services in a scope.
+	created   []any                    // built instances in creation order, see Stop.
 }
 
 func NewContainer() *Container {
 	return &Container{
-		types: make(map[string]interface{}),
+		types:     make(map[string]interface{}),
+		services:  make(map[serviceKey]*provider),
+		instances: make(map[serviceKey]*instance),
+	}
+}
+
+func (c *Container) root() *Container {
+	for c.parent != nil {
+		c = c.parent
 	}
+	return c
 }
 
 func (c *Container) RegisterType(name string, ctor interface{}) {
-	c.types[name] = ctor
+	r := c.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.types[name] = ctor
 }
 
+// RegisterSingletonType registers a constructor that is called once, on
+// the first Resolve.
 func (c *Container) RegisterSingletonType(name string, ctor interface{}) {
-	obj := ctor.(func() interface{})()
-	c.types[name] = func() interface{} {
-		return obj
+	fn, ok := ctor.(func() interface{})
+	if !ok {
+		c.RegisterType(name, ctor) // Resolve reports the invalid constructor.
+		return
 	}
+
+	var once sync.Once
+	var obj interface{}
+	c.RegisterType(name, func() interface{} {
+		once.Do(func() {
+			obj = fn()
+		})
+		return obj
+	})
 }
 
 func (c *Container) Resolve(name string) (interface{}, error) {
-	ctor, ok := c.types[name]
+	r := c.root()
+	r.mu.RLock()
+	ctor, ok := r.types[name]
+	r.mu.RUnlock()
 	if !ok {
 		return nil, os.ErrNotExist
 	}
-	return ctor.(func() interface{})(), nil
+
+	fn, ok := ctor.(func() interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: %q is %T, expected func() interface{}", ErrInvalidConstructor, name, ctor)
+	}
+	return fn(), nil
 }
 
 func TestDIContainer(t *testing.T) {
@@ -96,3 +137,45 @@ func TestDIContainer_RegisterSingletonType(t *testing.T) {
 
 	assert.True(t, unsafe.Pointer(u1) == unsafe.Pointer(u2))
 }
+
+func TestDIContainer_RegisterSingletonTypeIsLazy(t *testing.T) {
+	var calls atomic.Int64
+	container := NewContainer()
+	container.RegisterSingletonType("UserService", func() interface{} {
+		calls.Add(1)
+		return &UserService{}
+	})
+	assert.Equal(t, int64(0), calls.Load())
+
+	var wg sync.WaitGroup
+	services := make([]interface{}, 10)
+	for i := range services {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			services[i], _ = container.Resolve("UserService")
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(1), calls.Load())
+	for _, s := range services {
+		assert.True(t, s == services[0])
+	}
+}
+
+func TestDIContainer_InvalidConstructor(t *testing.T) {
+	container := NewContainer()
+	container.RegisterType("UserService", func() *UserService {
+		return &UserService{}
+	})
+	container.RegisterSingletonType("MessageService", &MessageService{})
+
+	userService, err := container.Resolve("UserService")
+	assert.ErrorIs(t, err, ErrInvalidConstructor)
+	assert.Nil(t, userService)
+
+	messageService, err := container.Resolve("MessageService")
+	assert.ErrorIs(t, err, ErrInvalidConstructor)
+	assert.Nil(t, messageService)
+}
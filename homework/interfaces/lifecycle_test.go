@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v -run 'Scope|Lifecycle|Singleton' .
+
+// Starter is implemented by services that need to be started, see Start.
+type Starter interface {
+	Start(ctx context.Context) error
+}
+
+// Stopper is implemented by services that need to be stopped, see Stop.
+// Services that implement io.Closer instead are closed.
+type Stopper interface {
+	Stop(ctx context.Context) error
+}
+
+// NewScope returns a child container, e.g. for a single request. The scope
+// shares the registrations and the singletons with its parent, while the
+// Scoped services are built once per scope. Call Stop when the scope ends.
+func (c *Container) NewScope() *Container {
+	return &Container{
+		parent:    c,
+		instances: make(map[serviceKey]*instance),
+	}
+}
+
+// Start builds all the singletons and starts the ones implementing Starter
+// in creation order, so every service is started after its dependencies.
+// If a service fails to start, the container forgets all the services it
+// has built and stops them in reverse order as Stop does, then the error
+// is returned. The failed service itself is not stopped: it must clean up
+// after its own failed Start.
+func (c *Container) Start(ctx context.Context) error {
+	c = c.root()
+
+	c.mu.RLock()
+	var keys []serviceKey
+	for k, p := range c.services {
+		if p.lifetime == Singleton {
+			keys = append(keys, k)
+		}
+	}
+	c.mu.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	for _, k := range keys {
+		if _, err := c.resolve(k, nil); err != nil {
+			return err
+		}
+	}
+
+	c.mu.RLock()
+	created := slices.Clone(c.created)
+	c.mu.RUnlock()
+
+	for i, service := range created {
+		s, ok := service.(Starter)
+		if !ok {
+			continue
+		}
+		if err := s.Start(ctx); err != nil {
+			created = c.forget()
+			return errors.Join(err, stop(ctx, slices.Delete(created, i, i+1)))
+		}
+	}
+	return nil
+}
+
+// Stop stops the services built by the container in reverse creation
+// order, so every service is stopped before its dependencies. A root
+// container stops the singletons and a scope stops its Scoped services.
+// Transient services are not tracked: their owner must stop them.
+// All the errors are returned joined.
+func (c *Container) Stop(ctx context.Context) error {
+	return stop(ctx, c.forget())
+}
+
+// forget drops the services built by the container and returns them in
+// creation order.
+func (c *Container) forget() []any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	created := c.created
+	c.created = nil
+	clear(c.instances)
+	return created
+}
+
+func stop(ctx context.Context, services []any) error {
+	var errs []error
+	for _, service := range slices.Backward(services) {
+		var err error
+		switch s := service.(type) {
+		case Stopper:
+			err = s.Stop(ctx)
+		case io.Closer:
+			err = s.Close()
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// component records the lifecycle calls into a shared log.
+type component struct {
+	name     string
+	log      *[]string
+	startErr error
+}
+
+func (c *component) Start(ctx context.Context) error {
+	*c.log = append(*c.log, "start "+c.name)
+	return c.startErr
+}
+
+func (c *component) Close() error {
+	*c.log = append(*c.log, "close "+c.name)
+	return nil
+}
+
+type (
+	config  struct{ *component }
+	storage struct{ *component }
+	server  struct{ *component }
+	request struct{ id int }
+)
+
+func TestSingleton_Lazy(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+
+	c := NewContainer()
+	assert.NoError(t, Register(c, func() (*Database, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return &Database{DSN: "postgres://localhost"}, nil
+	}, WithLifetime(Singleton)))
+	assert.Equal(t, 0, calls)
+
+	var wg sync.WaitGroup
+	dbs := make([]*Database, 10)
+	for i := range dbs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dbs[i], _ = Resolve[*Database](c.NewScope())
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, calls)
+	for _, db := range dbs {
+		assert.Same(t, dbs[0], db)
+	}
+}
+
+func TestSingleton_ErrorIsNotCached(t *testing.T) {
+	errUnavailable := errors.New("unavailable")
+
+	var calls int
+	c := NewContainer()
+	assert.NoError(t, Register(c, func() (*Database, error) {
+		if calls++; calls == 1 {
+			return nil, errUnavailable
+		}
+		return &Database{}, nil
+	}, WithLifetime(Singleton)))
+
+	_, err := Resolve[*Database](c)
+	assert.ErrorIs(t, err, errUnavailable)
+
+	db, err := Resolve[*Database](c)
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+}
+
+func TestScope(t *testing.T) {
+	var id int
+	c := NewContainer()
+	assert.NoError(t, Register(c, func() (*request, error) {
+		id++
+		return &request{id: id}, nil
+	}, WithLifetime(Scoped)))
+
+	_, err := Resolve[*request](c)
+	assert.ErrorIs(t, err, ErrScopeRequired)
+
+	first, second := c.NewScope(), c.NewScope()
+
+	r1, err := Resolve[*request](first)
+	assert.NoError(t, err)
+	r2, _ := Resolve[*request](first)
+	assert.Same(t, r1, r2)
+
+	r3, _ := Resolve[*request](second)
+	assert.NotSame(t, r1, r3)
+	assert.Equal(t, []int{1, 2}, []int{r1.id, r3.id})
+}
+
+func TestScope_Dependencies(t *testing.T) {
+	c := NewContainer()
+	assert.NoError(t, RegisterInstance(c, &Database{DSN: "postgres://localhost"}, WithLifetime(Singleton)))
+	assert.NoError(t, Register(c, func() (*request, error) { return &request{}, nil }, WithLifetime(Scoped)))
+	assert.NoError(t, Provide(c, func(db *Database, r *request) *UserRepository {
+		return &UserRepository{db: db}
+	}))
+
+	// a transient service gets the scoped services of the scope it is resolved from.
+	repo, err := Resolve[*UserRepository](c.NewScope())
+	assert.NoError(t, err)
+	assert.Equal(t, "postgres://localhost", repo.db.DSN)
+
+	_, err = Resolve[*UserRepository](c)
+	assert.ErrorIs(t, err, ErrScopeRequired)
+
+	// a singleton would keep the scoped service alive after its scope ends.
+	assert.NoError(t, Provide(c, func(r *request) *NotificationService {
+		return &NotificationService{}
+	}, WithLifetime(Singleton)))
+
+	_, err = Resolve[*NotificationService](c.NewScope())
+	assert.ErrorIs(t, err, ErrScopeRequired)
+	assert.ErrorIs(t, c.Validate(), ErrScopeRequired)
+}
+
+func newLifecycleContainer(log *[]string, serverErr error) *Container {
+	c := NewContainer()
+	_ = Provide(c, func() *config {
+		return &config{&component{name: "config", log: log}}
+	}, WithLifetime(Singleton))
+	_ = Provide(c, func(*config) *storage {
+		return &storage{&component{name: "storage", log: log}}
+	}, WithLifetime(Singleton))
+	_ = Provide(c, func(*storage, *config) *server {
+		return &server{&component{name: "server", log: log, startErr: serverErr}}
+	}, WithLifetime(Singleton))
+	return c
+}
+
+func TestLifecycle(t *testing.T) {
+	var log []string
+	c := newLifecycleContainer(&log, nil)
+
+	assert.NoError(t, c.Start(context.Background()))
+	assert.NoError(t, c.Stop(context.Background()))
+
+	assert.Equal(t, []string{
+		"start config", "start storage", "start server",
+		"close server", "close storage", "close config",
+	}, log)
+}
+
+func TestLifecycle_StartError(t *testing.T) {
+	errPortInUse := errors.New("port in use")
+
+	var log []string
+	c := newLifecycleContainer(&log, errPortInUse)
+
+	assert.ErrorIs(t, c.Start(context.Background()), errPortInUse)
+	assert.Equal(t, []string{
+		"start config", "start storage", "start server",
+		"close storage", "close config",
+	}, log)
+
+	// the services are already stopped and forgotten.
+	log = nil
+	assert.NoError(t, c.Stop(context.Background()))
+	assert.Empty(t, log)
+}
+
+func TestLifecycle_StartErrorBuiltAfter(t *testing.T) {
+	errInvalid := errors.New("invalid config")
+
+	var log []string
+	c := NewContainer()
+	assert.NoError(t, Provide(c, func() *config {
+		return &config{&component{name: "config", log: &log, startErr: errInvalid}}
+	}, WithLifetime(Singleton)))
+	assert.NoError(t, Provide(c, func(cfg *config) *storage {
+		return &storage{&component{name: "storage", log: cfg.log}}
+	}, WithLifetime(Singleton)))
+
+	// storage is built, but never started: it is closed, config is not.
+	assert.ErrorIs(t, c.Start(context.Background()), errInvalid)
+	assert.Equal(t, []string{"start config", "close storage"}, log)
+
+	log = nil
+	assert.NoError(t, c.Stop(context.Background()))
+	assert.Empty(t, log)
+}
+
+func TestLifecycle_Scope(t *testing.T) {
+	var log []string
+	c := newLifecycleContainer(&log, nil)
+	assert.NoError(t, Provide(c, func(s *storage) *request {
+		*s.log = append(*s.log, "begin request")
+		return &request{}
+	}, WithLifetime(Scoped)))
+
+	scope := c.NewScope()
+	_, err := Resolve[*request](scope)
+	assert.NoError(t, err)
+
+	// the scope doesn't stop the singletons it has built.
+	assert.NoError(t, scope.Stop(context.Background()))
+	assert.Equal(t, []string{"begin request"}, log)
+
+	assert.NoError(t, c.Stop(context.Background()))
+	assert.Equal(t, []string{"begin request", "close storage", "close config"}, log)
+}